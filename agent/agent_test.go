@@ -0,0 +1,512 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"loki/crypto"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var testStore = Store{ID: "6f1c7d2e-3b4a-4c5d-8e9f-0a1b2c3d4e5f", Generation: 1}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func mustEncodeStore(store Store) []byte {
+	payload, _ := encodeStore(store, nil)
+	return payload
+}
+
+// startServer serves the given server on a socket in a temporary directory and returns a client for it.
+func startServer(t *testing.T, s *Server) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "loki-agent")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	ln, err := Listen(socket)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket accessible by others: %v", info.Mode())
+	}
+
+	go s.Serve(ln)
+
+	return NewClient(socket), func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFraming(t *testing.T) {
+	var buf bytes.Buffer
+
+	sent := Message{Version: Version, Type: UpdateKey, Status: StatusLocked, Payload: []byte("payload")}
+
+	if err := WriteMessage(&buf, sent); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := ReadMessage(&buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Version != sent.Version || received.Type != sent.Type || received.Status != sent.Status || !bytes.Equal(received.Payload, sent.Payload) {
+		t.Errorf("received %+v, sent %+v", received, sent)
+	}
+
+	if err := WriteMessage(&buf, Message{Payload: make([]byte, maxPayloadSize+1)}); err == nil {
+		t.Error("oversized payload written")
+	}
+
+	// a frame announcing a payload above the limit is refused before it is read
+	frame := make([]byte, 4)
+	binary.BigEndian.PutUint32(frame, frameHeaderSize+maxPayloadSize+1)
+
+	if _, err := ReadMessage(bytes.NewReader(frame)); err == nil {
+		t.Error("oversized frame read")
+	}
+
+	binary.BigEndian.PutUint32(frame, frameHeaderSize+10)
+
+	if _, err := ReadMessage(bytes.NewReader(append(frame, 1, 2, 0))); err == nil {
+		t.Error("truncated frame read")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	s, err := NewServer(testStore, testKey(1), time.Minute, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan bool, 1)
+	s.OnShutdown = func() { shutdown <- true }
+
+	client, stop := startServer(t, s)
+	defer stop()
+
+	if err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := client.GetKey(testStore); err != nil || !bytes.Equal(key, testKey(1)) {
+		t.Errorf("got key %x: %v", key, err)
+	}
+
+	status, err := client.Status()
+
+	if err != nil || status.Locked || status.IdleDeadline.IsZero() || status.EndOfLife.Before(status.IdleDeadline) {
+		t.Errorf("unexpected status %+v: %v", status, err)
+	}
+
+	if status.PID != os.Getpid() || status.Started.After(time.Now()) || len(status.Stores) != 1 || status.Stores[0] != testStore {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	if err := client.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.GetKey(testStore); err != ErrLocked {
+		t.Errorf("key handed out while locked: %v", err)
+	}
+
+	if status, _ := client.Status(); !status.Locked {
+		t.Error("not locked")
+	}
+
+	if err := client.UpdateKey(testStore, []byte("short")); err == nil {
+		t.Error("short key accepted")
+	}
+
+	if err := client.UpdateKey(testStore, testKey(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := client.GetKey(testStore); err != nil || !bytes.Equal(key, testKey(2)) {
+		t.Errorf("got key %x after update: %v", key, err)
+	}
+
+	if _, err := client.Request(RequestType(99), nil); err == nil {
+		t.Error("unknown request answered")
+	}
+
+	if err := client.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Error("no shutdown")
+	}
+
+	if _, err := client.GetKey(testStore); err != ErrLocked {
+		t.Errorf("key not wiped on shutdown: %v", err)
+	}
+}
+
+func TestSealed(t *testing.T) {
+	s, err := NewServer(testStore, testKey(1), time.Minute, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Sealed = true
+	client, stop := startServer(t, s)
+	defer stop()
+
+	if _, err := client.GetKey(testStore); err != ErrSealed {
+		t.Errorf("key handed out by sealed agent: %v", err)
+	}
+
+	if status, err := client.Status(); err != nil || !status.Sealed || status.Locked {
+		t.Errorf("unexpected status %+v: %v", status, err)
+	}
+
+	// the client is a key like any other, ciphertexts are interchangeable with the local key
+	var key crypto.Key = client.Key(testStore)
+	local := crypto.LocalKey(testKey(1))
+	e, _ := crypto.NewEngineForCipher(crypto.CipherXChaCha20Poly1305)
+
+	ciphertext, err := key.Encrypt(e, []byte("secret"), []byte("header"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext, err := local.Decrypt(e, ciphertext, []byte("header")); err != nil || string(plaintext) != "secret" {
+		t.Errorf("decrypted %q: %v", plaintext, err)
+	}
+
+	ciphertext, _ = local.Encrypt(crypto.NewEngine(), []byte("secret"), nil)
+
+	if plaintext, err := key.Decrypt(crypto.NewEngine(), ciphertext, nil); err != nil || string(plaintext) != "secret" {
+		t.Errorf("decrypted %q: %v", plaintext, err)
+	}
+
+	if _, err := key.Decrypt(crypto.NewEngine(), ciphertext, []byte("other header")); err == nil {
+		t.Error("tampered additional data accepted")
+	}
+
+	if _, err := client.storeRequest(Decrypt, testStore, []byte{0, 0, 0, 1, 0, 0, 1, 0}); err == nil {
+		t.Error("truncated crypto request answered")
+	}
+
+	client.Lock()
+
+	if _, err := key.Encrypt(e, []byte("secret"), nil); err != ErrLocked {
+		t.Errorf("encrypted while locked: %v", err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	s, err := NewServer(testStore, testKey(1), 0, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, stop := startServer(t, s)
+	defer stop()
+
+	team := Store{ID: "team", Generation: 3}
+
+	if _, err := client.GetKey(team); err != ErrUnknownStore {
+		t.Errorf("key of unknown store handed out: %v", err)
+	}
+
+	if err := client.UpdateKey(team, testKey(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := client.GetKey(testStore); err != nil || !bytes.Equal(key, testKey(1)) {
+		t.Errorf("got key %x: %v", key, err)
+	}
+
+	if key, err := client.GetKey(team); err != nil || !bytes.Equal(key, testKey(3)) {
+		t.Errorf("got team key %x: %v", key, err)
+	}
+
+	// the team store was rekeyed, the key of the next generation evicts the stale one
+	team.Generation++
+
+	if err := client.UpdateKey(team, testKey(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := client.Status(); len(status.Stores) != 2 || status.Stores[1] != team {
+		t.Errorf("stale key not evicted: %v", status.Stores)
+	}
+
+	// a client asking for a newer generation evicts as well
+	rekeyed := Store{ID: testStore.ID, Generation: testStore.Generation + 1}
+
+	if _, err := client.GetKey(rekeyed); err != ErrUnknownStore {
+		t.Errorf("key of next generation handed out: %v", err)
+	}
+
+	if _, err := client.GetKey(testStore); err != ErrUnknownStore {
+		t.Errorf("stale key handed out: %v", err)
+	}
+
+	if err := client.Forget(team); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := client.Status(); !status.Locked || len(status.Stores) != 0 {
+		t.Errorf("keys left: %+v", status)
+	}
+}
+
+func TestNotListening(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki-agent")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "agent.sock")
+	client := NewClient(socket)
+
+	if err := client.Ping(); err == nil || err == ErrNotListening {
+		t.Errorf("missing socket reported as %v", err)
+	}
+
+	ln, err := Listen(socket)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a killed agent leaves its socket behind
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	if err := client.Ping(); err != ErrNotListening {
+		t.Errorf("socket left behind reported as %v", err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	s, err := NewServer(testStore, testKey(1), 0, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := s.Handle(Message{Version: Version + 1, Type: GetKey})
+
+	if response.Status != StatusUnsupportedVersion || len(response.Payload) > 0 {
+		t.Errorf("unexpected response %+v", response)
+	}
+
+	if status := s.Status(); !status.IdleDeadline.IsZero() || !status.EndOfLife.IsZero() {
+		t.Errorf("disabled timeouts have deadlines: %+v", status)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	s, err := NewServer(testStore, testKey(1), time.Minute, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reason := s.Expired(time.Now()); len(reason) > 0 {
+		t.Errorf("expired right away: %s", reason)
+	}
+
+	if reason := s.Expired(time.Now().Add(2 * time.Minute)); len(reason) == 0 {
+		t.Error("idle timeout not expired")
+	}
+
+	s.Handle(Message{Version: Version, Type: GetKey, Payload: mustEncodeStore(testStore)})
+
+	if reason := s.Expired(time.Now().Add(61 * time.Minute)); len(reason) == 0 {
+		t.Error("lifetime not expired")
+	}
+}
+
+func TestCallerCheck(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the executable of the caller is only known on linux")
+	}
+
+	self, err := os.Executable()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for caller, answered := range map[string]bool{self: true, filepath.Join(os.TempDir(), "not-loki"): false} {
+		s, err := NewServer(testStore, testKey(1), 0, 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Caller = caller
+		client, stop := startServer(t, s)
+
+		if err := client.Ping(); (err == nil) != answered {
+			t.Errorf("caller %s: answered %t, expected %t", caller, err == nil, answered)
+		}
+
+		stop()
+	}
+}
+
+func TestPrivateDir(t *testing.T) {
+	base, err := ioutil.TempDir("", "loki-private")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(base)
+
+	dir := filepath.Join(base, "run", "loki")
+
+	if err := PrivateDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("directory not private: %v", err)
+	}
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PrivateDir(dir); err == nil {
+		t.Error("directory readable by others accepted")
+	}
+
+	file := filepath.Join(base, "file")
+
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PrivateDir(file); err == nil {
+		t.Error("file accepted as directory")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	s, err := NewServer(testStore, testKey(1), 0, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var asked int
+	var answer error
+
+	s.Confirm = func(prompt string) error {
+		asked++
+		return answer
+	}
+
+	client, stop := startServer(t, s)
+	defer stop()
+
+	if status, err := client.Status(); err != nil || !status.Confirm || asked != 0 {
+		t.Errorf("unexpected status %+v, asked %d times: %v", status, asked, err)
+	}
+
+	answer = ErrDenied
+
+	if _, err := client.GetKey(testStore); err != ErrDenied || asked != 1 {
+		t.Errorf("key handed out without confirmation: %v", err)
+	}
+
+	answer = ErrConfirmTimeout
+
+	if _, err := client.GetKey(testStore); err != ErrConfirmTimeout || asked != 2 {
+		t.Errorf("key handed out without confirmation in time: %v", err)
+	}
+
+	// without a grace period every use is confirmed
+	answer = nil
+
+	for i := 0; i < 2; i++ {
+		if key, err := client.GetKey(testStore); err != nil || !bytes.Equal(key, testKey(1)) {
+			t.Errorf("got key %x: %v", key, err)
+		}
+	}
+
+	if asked != 4 {
+		t.Errorf("asked %d times", asked)
+	}
+
+	// the confirmation covers the further requests of the process within the grace period
+	s.ConfirmGrace = time.Minute
+
+	for i := 0; i < 3; i++ {
+		if key, err := client.GetKey(testStore); err != nil || !bytes.Equal(key, testKey(1)) {
+			t.Errorf("got key %x: %v", key, err)
+		}
+	}
+
+	if asked != 5 {
+		t.Errorf("asked %d times", asked)
+	}
+
+	// nothing to confirm for a store the agent holds no key for
+	if _, err := client.GetKey(Store{ID: "team"}); err != ErrUnknownStore || asked != 5 {
+		t.Errorf("unknown store: %v, asked %d times", err, asked)
+	}
+
+	// locking revokes the confirmations given
+	if err := client.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.UpdateKey(testStore, testKey(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	answer = ErrDenied
+	e := crypto.NewEngine()
+
+	if _, err := client.Key(testStore).Encrypt(e, []byte("secret"), nil); err != ErrDenied || asked != 6 {
+		t.Errorf("encrypted without confirmation: %v", err)
+	}
+}
+
+func TestConfirmWithHelper(t *testing.T) {
+	if err := ConfirmWithHelper("true")("Allow?"); err != nil {
+		t.Errorf("not confirmed: %v", err)
+	}
+
+	if err := ConfirmWithHelper("false")("Allow?"); err != ErrDenied {
+		t.Errorf("not denied: %v", err)
+	}
+
+	if err := ConfirmWithHelper("/nonexistent/askpass")("Allow?"); err == nil {
+		t.Error("confirmed by missing helper")
+	}
+}
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"loki/crypto"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrLocked is returned when the agent is running but holds no key.
+var ErrLocked = errors.New(StatusLocked.String())
+
+// ErrSealed is returned when the agent does not hand out its key, it has to be used through Encrypt and Decrypt.
+var ErrSealed = errors.New(StatusSealed.String())
+
+// ErrUnknownStore is returned when the agent holds keys, but none for the store asked for.
+var ErrUnknownStore = errors.New(StatusUnknownStore.String())
+
+// ErrDenied is returned when the user refused to confirm the use of the key at the agent.
+var ErrDenied = errors.New(StatusDenied.String())
+
+// ErrConfirmTimeout is returned when the user did not confirm the use of the key at the agent in time.
+var ErrConfirmTimeout = errors.New(StatusConfirmTimeout.String())
+
+// ErrNotListening is returned when the socket file exists, but nobody listens on it. The agent left it behind.
+var ErrNotListening = errors.New("nobody listening on the socket")
+
+// dialTimeout limits the time waited for a hanging agent.
+const dialTimeout = 5 * time.Second
+
+// Client talks to the agent listening on the socket.
+type Client struct {
+	socket string
+}
+
+// NewClient returns a client for the agent listening on the given socket file.
+func NewClient(socket string) *Client {
+	return &Client{socket: socket}
+}
+
+// Request sends one request and returns the response. Responses with another status than StatusOK are returned as
+// error, StatusLocked as ErrLocked, StatusSealed as ErrSealed, StatusUnknownStore as ErrUnknownStore, StatusDenied as
+// ErrDenied and StatusConfirmTimeout as ErrConfirmTimeout. A socket nobody listens on gives ErrNotListening. Requests
+// using a key wait for the user to confirm them.
+func (c *Client) Request(t RequestType, payload []byte) (Message, error) {
+	if _, err := os.Stat(c.socket); err != nil {
+		return Message{}, errors.New("Socketfile not found")
+	}
+
+	conn, err := net.DialTimeout("unix", c.socket, dialTimeout)
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return Message{}, ErrNotListening
+	}
+
+	if err != nil {
+		return Message{}, errors.New("Dial error")
+	}
+
+	defer conn.Close()
+
+	if t.usesKey() {
+		conn.SetDeadline(time.Now().Add(dialTimeout + ConfirmTimeout))
+	} else {
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+	}
+
+	if err := WriteMessage(conn, Message{Version: Version, Type: t, Payload: payload}); err != nil {
+		return Message{}, fmt.Errorf("Error writing request: %v", err)
+	}
+
+	response, err := ReadMessage(conn)
+
+	if err != nil {
+		return Message{}, fmt.Errorf("Error reading response: %v", err)
+	}
+
+	if response.Version != Version || response.Type != t {
+		return Message{}, fmt.Errorf("unexpected response: version %d, type %d", response.Version, response.Type)
+	}
+
+	switch response.Status {
+	case StatusOK:
+		return response, nil
+	case StatusLocked:
+		return response, ErrLocked
+	case StatusSealed:
+		return response, ErrSealed
+	case StatusUnknownStore:
+		return response, ErrUnknownStore
+	case StatusDenied:
+		return response, ErrDenied
+	case StatusConfirmTimeout:
+		return response, ErrConfirmTimeout
+	}
+
+	return response, errors.New(response.Status.String())
+}
+
+// Ping checks whether an agent is listening, locked or not.
+func (c *Client) Ping() error {
+	_, err := c.Request(Ping, nil)
+	return err
+}
+
+// GetKey returns the masterkey of the store held by the agent.
+func (c *Client) GetKey(store Store) ([]byte, error) {
+	response, err := c.storeRequest(GetKey, store, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Payload, nil
+}
+
+// Lock makes the agent wipe all keys, it keeps running until UpdateKey unlocks it again.
+func (c *Client) Lock() error {
+	_, err := c.Request(Lock, nil)
+	return err
+}
+
+// Forget makes the agent wipe the key of the store, the keys of other stores are kept.
+func (c *Client) Forget(store Store) error {
+	_, err := c.storeRequest(Lock, store, nil)
+	return err
+}
+
+// Status returns the state of the agent.
+func (c *Client) Status() (Status, error) {
+	response, err := c.Request(GetStatus, nil)
+
+	if err != nil {
+		return Status{}, err
+	}
+
+	return decodeStatus(response.Payload)
+}
+
+// Shutdown makes the agent wipe all keys and exit.
+func (c *Client) Shutdown() error {
+	_, err := c.Request(Shutdown, nil)
+	return err
+}
+
+// UpdateKey replaces the key of the store held by the agent, a locked agent is unlocked. The keys of older
+// generations of the store are evicted.
+func (c *Client) UpdateKey(store Store, key []byte) error {
+	_, err := c.storeRequest(UpdateKey, store, key)
+	return err
+}
+
+// Key returns the key of the store held by the agent, to be used through the agent.
+func (c *Client) Key(store Store) *StoreKey {
+	return &StoreKey{client: c, store: store}
+}
+
+// storeRequest sends a request concerning the key of the store.
+func (c *Client) storeRequest(t RequestType, store Store, rest []byte) (Message, error) {
+	payload, err := encodeStore(store, rest)
+
+	if err != nil {
+		return Message{}, err
+	}
+
+	return c.Request(t, payload)
+}
+
+// StoreKey is the key of one store held by the agent. It is a crypto.Key encrypting and decrypting through the
+// agent, the key itself never leaves it.
+type StoreKey struct {
+	client *Client
+	store  Store
+}
+
+// Encrypt encrypts data with the key using the cipher of the given engine.
+func (k *StoreKey) Encrypt(e crypto.Engine, data []byte, additionalData []byte) ([]byte, error) {
+	return k.crypt(Encrypt, e, data, additionalData)
+}
+
+// Decrypt decrypts data with the key using the cipher of the given engine.
+func (k *StoreKey) Decrypt(e crypto.Engine, data []byte, additionalData []byte) ([]byte, error) {
+	return k.crypt(Decrypt, e, data, additionalData)
+}
+
+func (k *StoreKey) crypt(t RequestType, e crypto.Engine, data []byte, additionalData []byte) ([]byte, error) {
+	response, err := k.client.storeRequest(t, k.store, encodeCryptoRequest(e.Cipher(), data, additionalData))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Payload, nil
+}
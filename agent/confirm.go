@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ConfirmTimeout is the time the user has to confirm the use of a key, clients wait this long for the answer.
+const ConfirmTimeout = 30 * time.Second
+
+// A Confirmer asks the user whether the request described by the prompt may use a key. It returns nil if the user
+// agreed, ErrDenied if not and ErrConfirmTimeout if the user did not answer within ConfirmTimeout.
+type Confirmer func(prompt string) error
+
+// ConfirmOnTerminal asks on the controlling terminal of the agent, the terminal loki was run on when it started the
+// agent. The agent takes the foreground of the terminal for the question, SIGTTOU has to be ignored for this.
+func ConfirmOnTerminal(prompt string) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer tty.Close()
+
+	// loki started the agent in a process group of its own, which is never the foreground one
+	if previous, err := foreground(tty, syscall.Getpgrp()); err == nil {
+		defer foreground(tty, previous)
+	}
+
+	if err := tty.SetReadDeadline(time.Now().Add(ConfirmTimeout)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(tty, "\nloki-agentd: %s [y/N] ", prompt)
+
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+
+	if os.IsTimeout(err) {
+		fmt.Fprintln(tty, "timed out")
+		return ErrConfirmTimeout
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer == "y" || answer == "yes" {
+		return nil
+	}
+
+	return ErrDenied
+}
+
+// foreground makes the process group the foreground process group of the terminal and returns the previous one.
+func foreground(tty *os.File, pgrp int) (int, error) {
+	raw, err := tty.SyscallConn()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var previous, next int32 = 0, int32(pgrp)
+	var errno syscall.Errno
+
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&previous)))
+
+		if errno == 0 && previous != next {
+			_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&next)))
+		}
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(previous), nil
+}
+
+// ConfirmWithHelper returns a Confirmer running the helper program with the prompt as argument, exit status 0
+// confirms. SSH_ASKPASS_PROMPT is set to confirm, so ssh-askpass could be used as helper.
+func ConfirmWithHelper(helper string) Confirmer {
+	return func(prompt string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), ConfirmTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, helper, prompt)
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+
+		err := cmd.Run()
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrConfirmTimeout
+		}
+
+		if _, ok := err.(*exec.ExitError); ok {
+			return ErrDenied
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// the options of getsockopt on the SOL_LOCAL level, see sys/un.h
+const (
+	solLocal       = 0
+	localPeerCred  = 0x001
+	localPeerPID   = 0x002
+	xucredVersion  = 0
+	xucredMaxGroup = 16
+)
+
+// xucred is the struct returned for LOCAL_PEERCRED, see sys/ucred.h
+type xucred struct {
+	Version uint32
+	UID     uint32
+	NGroups int16
+	Groups  [xucredMaxGroup]uint32
+}
+
+// CallerCheckSupported tells whether the executable of the peer is known, which Server.Caller needs.
+const CallerCheckSupported = false
+
+// peerCredentials returns the user id and the process id of the process connected to the unix domain socket. The
+// kernel records them when the connection is made (LOCAL_PEERCRED, LOCAL_PEERPID), the peer could not fake them. The
+// executable is not known.
+func peerCredentials(c net.Conn) (peer, error) {
+	uc, ok := c.(*net.UnixConn)
+
+	if !ok {
+		return peer{}, errors.New("no unix domain socket")
+	}
+
+	raw, err := uc.SyscallConn()
+
+	if err != nil {
+		return peer{}, err
+	}
+
+	var cred xucred
+	var pid int32
+	var errno syscall.Errno
+
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(cred))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeerCred,
+			uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&size)), 0)
+
+		if errno != 0 {
+			return
+		}
+
+		size = uint32(unsafe.Sizeof(pid))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeerPID,
+			uintptr(unsafe.Pointer(&pid)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+
+	if err != nil {
+		return peer{}, err
+	}
+
+	if errno != 0 {
+		return peer{}, errno
+	}
+
+	if cred.Version != xucredVersion {
+		return peer{}, errors.New("unexpected version of the peer credentials")
+	}
+
+	return peer{uid: int(cred.UID), pid: int(pid)}, nil
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// CallerCheckSupported tells whether the executable of the peer is known, which Server.Caller needs.
+const CallerCheckSupported = true
+
+// peerCredentials returns the user id, the process id and the executable of the process connected to the unix domain
+// socket. The kernel records them when the connection is made (SO_PEERCRED), the peer could not fake them.
+func peerCredentials(c net.Conn) (peer, error) {
+	uc, ok := c.(*net.UnixConn)
+
+	if !ok {
+		return peer{}, errors.New("no unix domain socket")
+	}
+
+	raw, err := uc.SyscallConn()
+
+	if err != nil {
+		return peer{}, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	if err != nil {
+		return peer{}, err
+	}
+
+	if credErr != nil {
+		return peer{}, credErr
+	}
+
+	// the executable is only needed if callers are restricted to the loki binary, it might be gone already
+	exe, _ := os.Readlink("/proc/" + strconv.Itoa(int(cred.Pid)) + "/exe")
+	return peer{uid: int(cred.Uid), pid: int(cred.Pid), exe: exe}, nil
+}
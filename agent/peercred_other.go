@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+// CallerCheckSupported tells whether the executable of the peer is known, which Server.Caller needs.
+const CallerCheckSupported = false
+
+// peerCredentials is not implemented on this platform, every client is refused.
+func peerCredentials(c net.Conn) (peer, error) {
+	return peer{}, errors.New("peer credentials not supported on this platform")
+}
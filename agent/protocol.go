@@ -0,0 +1,313 @@
+// Package agent implements the protocol spoken between loki and loki-agentd on the unix domain socket. Both sides
+// exchange framed messages, every request is answered by exactly one response:
+//
+// Length     : 00 00 00 23     :  4 : Size of the rest of the frame
+// Version    : 02              :  1 : Protocol version
+// Type       : 02              :  1 : Request type, the response repeats it
+// Status     : 00              :  1 : Status code of the response, always 0 in requests
+// Payload    : .........       :    : Variable-sized payload, depending on the type
+//
+// The agent holds the keys of several stores, the requests concerning one of them start their payload with an
+// encoded Store. Version 2 introduced this.
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"loki/crypto"
+	"time"
+)
+
+// Version is the protocol version spoken by this package.
+const Version byte = 2
+
+// maxPayloadSize limits the memory allocated for a message read from the socket. It has to hold the index of hidden
+// names and records written before format version 4, both are encrypted with the masterkey directly.
+const maxPayloadSize = 1024 * 1024
+
+// frameHeaderSize is the size of version, type and status following the length.
+const frameHeaderSize = 3
+
+// RequestType tells the agent what to do.
+type RequestType byte
+
+// The requests understood by the agent.
+const (
+	Ping      RequestType = 1 // answered with StatusOK, locked or not
+	GetKey    RequestType = 2 // the payload of the request is a store, the response its masterkey
+	Lock      RequestType = 3 // the key of the store given or all keys are wiped, the agent keeps running
+	GetStatus RequestType = 4 // the payload of the response is an encoded Status
+	Shutdown  RequestType = 5 // all keys are wiped and the agent exits
+	UpdateKey RequestType = 6 // a store followed by its key, older generations of the store are evicted
+	Encrypt   RequestType = 7 // a store and a crypto request, the payload of the response is the ciphertext
+	Decrypt   RequestType = 8 // a store and a crypto request, the payload of the response is the plaintext
+)
+
+// usesKey tells whether the request hands out or uses the key of a store, these have to be confirmed by the user if
+// the agent asks for confirmation.
+func (t RequestType) usesKey() bool {
+	return t == GetKey || t == Encrypt || t == Decrypt
+}
+
+// StatusCode tells the client how the agent handled the request.
+type StatusCode byte
+
+// The status codes of the responses.
+const (
+	StatusOK                 StatusCode = 0
+	StatusLocked             StatusCode = 1 // the agent holds no key
+	StatusBadRequest         StatusCode = 2 // unknown request type or malformed payload
+	StatusUnsupportedVersion StatusCode = 3
+	StatusError              StatusCode = 4
+	StatusSealed             StatusCode = 5 // the agent does not hand out the key, use Encrypt and Decrypt
+	StatusUnknownStore       StatusCode = 6 // the agent holds keys, but none for the store and generation given
+	StatusDenied             StatusCode = 7 // the user refused to confirm the use of the key
+	StatusConfirmTimeout     StatusCode = 8 // the user did not confirm the use of the key in time
+)
+
+var statusTexts = map[StatusCode]string{
+	StatusOK:                 "ok",
+	StatusLocked:             "agent locked",
+	StatusBadRequest:         "bad request",
+	StatusUnsupportedVersion: "unsupported protocol version",
+	StatusError:              "agent error",
+	StatusSealed:             "agent keeps the key",
+	StatusUnknownStore:       "no key for this store",
+	StatusDenied:             "use of the key denied at the agent",
+	StatusConfirmTimeout:     "use of the key not confirmed at the agent in time",
+}
+
+func (s StatusCode) String() string {
+	if text, ok := statusTexts[s]; ok {
+		return text
+	}
+
+	return fmt.Sprintf("unknown status %d", s)
+}
+
+// Message is a request or a response.
+type Message struct {
+	Version byte
+	Type    RequestType
+	Status  StatusCode
+	Payload []byte
+}
+
+// WriteMessage writes the message as one frame.
+func WriteMessage(w io.Writer, m Message) error {
+	if len(m.Payload) > maxPayloadSize {
+		return fmt.Errorf("payload too large: %d bytes", len(m.Payload))
+	}
+
+	frame := make([]byte, 4+frameHeaderSize, 4+frameHeaderSize+len(m.Payload))
+	binary.BigEndian.PutUint32(frame, uint32(frameHeaderSize+len(m.Payload)))
+	frame[4] = m.Version
+	frame[5] = byte(m.Type)
+	frame[6] = byte(m.Status)
+
+	_, err := w.Write(append(frame, m.Payload...))
+	return err
+}
+
+// ReadMessage reads one frame. Frames exceeding the payload limit are refused before their payload is read.
+func ReadMessage(r io.Reader) (Message, error) {
+	length := make([]byte, 4)
+
+	if _, err := io.ReadFull(r, length); err != nil {
+		return Message{}, err
+	}
+
+	size := binary.BigEndian.Uint32(length)
+
+	if size < frameHeaderSize || size > frameHeaderSize+maxPayloadSize {
+		return Message{}, fmt.Errorf("invalid frame size: %d", size)
+	}
+
+	frame := make([]byte, size)
+
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return Message{}, errors.New("frame truncated")
+	}
+
+	return Message{
+		Version: frame[0],
+		Type:    RequestType(frame[1]),
+		Status:  StatusCode(frame[2]),
+		Payload: frame[frameHeaderSize:],
+	}, nil
+}
+
+// Store selects the key of one store: the ID recorded in its masterfile and the generation of its masterkey.
+type Store struct {
+	ID         string
+	Generation uint32
+}
+
+func (s Store) String() string {
+	return fmt.Sprintf("%s/%d", s.ID, s.Generation)
+}
+
+// An encoded Store precedes the rest of the payload of the requests concerning the key of one store:
+//
+// Generation : 00 00 00 01     :  4 : Generation of the masterkey
+// ID size    : 24              :  1 : Size of the store ID
+// ID         : .........       :    : The store ID, a UUID
+func encodeStore(s Store, rest []byte) ([]byte, error) {
+	if len(s.ID) > 255 {
+		return nil, fmt.Errorf("store ID too long: %d bytes", len(s.ID))
+	}
+
+	payload := make([]byte, 5, 5+len(s.ID)+len(rest))
+	binary.BigEndian.PutUint32(payload, s.Generation)
+	payload[4] = byte(len(s.ID))
+
+	return append(append(payload, s.ID...), rest...), nil
+}
+
+// decodeStore returns the store the payload starts with and the rest of the payload.
+func decodeStore(payload []byte) (Store, []byte, error) {
+	if len(payload) < 5 || len(payload) < 5+int(payload[4]) {
+		return Store{}, nil, errors.New("store truncated")
+	}
+
+	size := 5 + int(payload[4])
+	return Store{ID: string(payload[5:size]), Generation: binary.BigEndian.Uint32(payload)}, payload[size:], nil
+}
+
+// Status describes the state of the agent. Disabled timeouts give the zero time.
+type Status struct {
+	Locked       bool      // the agent holds no key at all
+	Sealed       bool      // the keys are never handed out
+	Confirm      bool      // every use of a key has to be confirmed by the user
+	PID          int       // the process of the agent
+	Started      time.Time // the maximum lifetime counts from here
+	Stores       []Store   // the stores the agent holds keys for, ordered by ID and generation
+	IdleDeadline time.Time // moved on with every use of a key
+	EndOfLife    time.Time
+}
+
+// An encoded Status, the payload of the response to GetStatus:
+//
+// Flags      : 01              :  1 : statusLocked, statusSealed, statusConfirm
+// PID        : 00 00 30 39     :  4 : Process ID of the agent
+// Started    : .........       :  8 : Unix time the agent was started
+// Idle       : .........       :  8 : Unix time of the idle deadline, 0 if disabled
+// End        : .........       :  8 : Unix time of the end of life, 0 if disabled
+// Stores     : .........       :    : The rest of the payload are the encoded stores held
+const statusHeaderSize = 1 + 4 + 8 + 8 + 8
+
+// the flags of an encoded Status
+const (
+	statusLocked  byte = 1
+	statusSealed  byte = 2
+	statusConfirm byte = 4
+)
+
+func (s Status) encode() ([]byte, error) {
+	data := make([]byte, statusHeaderSize)
+
+	if s.Locked {
+		data[0] |= statusLocked
+	}
+
+	if s.Sealed {
+		data[0] |= statusSealed
+	}
+
+	if s.Confirm {
+		data[0] |= statusConfirm
+	}
+
+	binary.BigEndian.PutUint32(data[1:], uint32(s.PID))
+	binary.BigEndian.PutUint64(data[5:], uint64(unixOrZero(s.Started)))
+	binary.BigEndian.PutUint64(data[13:], uint64(unixOrZero(s.IdleDeadline)))
+	binary.BigEndian.PutUint64(data[21:], uint64(unixOrZero(s.EndOfLife)))
+
+	for _, store := range s.Stores {
+		encoded, err := encodeStore(store, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, encoded...)
+	}
+
+	return data, nil
+}
+
+func decodeStatus(data []byte) (Status, error) {
+	if len(data) < statusHeaderSize {
+		return Status{}, fmt.Errorf("invalid status size: %d", len(data))
+	}
+
+	status := Status{
+		Locked:       data[0]&statusLocked != 0,
+		Sealed:       data[0]&statusSealed != 0,
+		Confirm:      data[0]&statusConfirm != 0,
+		PID:          int(binary.BigEndian.Uint32(data[1:])),
+		Started:      timeOrZero(int64(binary.BigEndian.Uint64(data[5:]))),
+		IdleDeadline: timeOrZero(int64(binary.BigEndian.Uint64(data[13:]))),
+		EndOfLife:    timeOrZero(int64(binary.BigEndian.Uint64(data[21:]))),
+	}
+
+	for rest := data[statusHeaderSize:]; len(rest) > 0; {
+		var store Store
+		var err error
+
+		if store, rest, err = decodeStore(rest); err != nil {
+			return Status{}, err
+		}
+
+		status.Stores = append(status.Stores, store)
+	}
+
+	return status, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(unix, 0)
+}
+
+// An encoded crypto request, the payload of Encrypt and Decrypt requests:
+//
+// Cipher     : 00 00 00 01     :  4 : The cipher to use, see crypto.Cipher
+// AD size    : 00 00 00 18     :  4 : Size of the additional data
+// AD         : .........       :    : Additional data, authenticated but not encrypted
+// Data       : .........       :    : The rest of the payload is the data to encrypt or decrypt
+func encodeCryptoRequest(c crypto.Cipher, data []byte, additionalData []byte) []byte {
+	payload := make([]byte, 8, 8+len(additionalData)+len(data))
+	binary.BigEndian.PutUint32(payload, uint32(c))
+	binary.BigEndian.PutUint32(payload[4:], uint32(len(additionalData)))
+
+	return append(append(payload, additionalData...), data...)
+}
+
+func decodeCryptoRequest(payload []byte) (crypto.Cipher, []byte, []byte, error) {
+	if len(payload) < 8 {
+		return 0, nil, nil, errors.New("crypto request truncated")
+	}
+
+	c := crypto.Cipher(binary.BigEndian.Uint32(payload))
+	size := binary.BigEndian.Uint32(payload[4:])
+
+	if uint64(size) > uint64(len(payload)-8) {
+		return 0, nil, nil, fmt.Errorf("invalid additional data size: %d", size)
+	}
+
+	return c, payload[8+size:], payload[8 : 8+size], nil
+}
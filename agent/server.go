@@ -0,0 +1,542 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"loki/config"
+	"loki/crypto"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/awnumar/memguard"
+)
+
+// Server holds the masterkeys of the stores in locked memory and answers the requests of the clients. The keys are
+// kept by store ID and generation, a key of a newer generation evicts the older ones of the same store. It forgets
+// the keys when none was used for the idle timeout or when the maximum lifetime is over, 0 disables them. Only
+// processes of the user running the server are answered.
+type Server struct {
+	// OnShutdown is called after a Shutdown request was answered, the key is already wiped then.
+	OnShutdown func()
+
+	// Caller restricts the clients to processes running this executable, if given. Needs CallerCheckSupported.
+	Caller string
+
+	// Sealed keeps the keys inside the server, GetKey is refused and the clients have to use Encrypt and Decrypt.
+	Sealed bool
+
+	// Confirm, if set, asks the user before a key is handed out or used.
+	Confirm Confirmer
+
+	// ConfirmGrace is how long a confirmation covers the further requests of the same process for the same store,
+	// extended by every request. Commands like ls or search use the key for every record of a sealed agent. With 0,
+	// the default, every use is confirmed.
+	ConfirmGrace time.Duration
+
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	started     time.Time
+	lastUse     time.Time
+
+	mutex  sync.Mutex
+	keys   map[Store]*memguard.LockedBuffer // empty while locked
+	grants map[grant]time.Time              // the confirmations given, until they lapse
+
+	confirmMutex sync.Mutex // one confirmation at a time
+}
+
+// grant is a confirmation given to a process to use the key of a store.
+type grant struct {
+	pid   int
+	store Store
+}
+
+// peer is the process connected to the socket as recorded by the kernel.
+type peer struct {
+	uid int
+	pid int    // 0 if unknown
+	exe string // empty if unknown
+}
+
+func (p peer) String() string {
+	if len(p.exe) > 0 {
+		return fmt.Sprintf("%s (pid %d)", p.exe, p.pid)
+	}
+
+	return fmt.Sprintf("pid %d", p.pid)
+}
+
+// NewServer returns a server holding the key of the given store. The key is copied into locked memory and wiped
+// from the slice.
+func NewServer(store Store, key []byte, idleTimeout time.Duration, maxLifetime time.Duration) (*Server, error) {
+	s := &Server{idleTimeout: idleTimeout, maxLifetime: maxLifetime, started: time.Now()}
+	s.lastUse = s.started
+	s.keys = make(map[Store]*memguard.LockedBuffer)
+	s.grants = make(map[grant]time.Time)
+
+	if err := s.setKey(store, key); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Listen creates the unix domain socket only accessible by the user. The umask is set before the socket file is
+// created, so there is no moment it is accessible by others. The umask is process wide, Listen has to be called
+// before other goroutines create files.
+func Listen(socket string) (net.Listener, error) {
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+
+	return net.Listen("unix", socket)
+}
+
+// PrivateDir creates the directory accessible by the user only. An existing directory has to be owned by the user and
+// must not be accessible by others, otherwise they could replace the socket or read the log.
+func PrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(dir)
+
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("directory %s is owned by another user", dir)
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("directory %s is accessible by other users, mode %o", dir, fi.Mode().Perm())
+	}
+
+	return nil
+}
+
+// Serve accepts connections on the listener until it is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(c)
+	}
+}
+
+// serveConn answers the requests sent on the connection until the client closes it.
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+
+	p, err := s.checkPeer(c)
+
+	if err != nil {
+		log.Printf("Refused connection: %v", err)
+		return
+	}
+
+	for {
+		request, err := ReadMessage(c)
+
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Read error: %v", err)
+			}
+			return
+		}
+
+		response := Message{Version: Version, Type: request.Type, Status: s.confirm(p, request)}
+
+		if response.Status == StatusOK {
+			response = s.Handle(request)
+		}
+
+		if err := WriteMessage(c, response); err != nil {
+			log.Printf("Write error: %v", err)
+			return
+		}
+
+		if request.Type == Shutdown && request.Version == Version && s.OnShutdown != nil {
+			s.OnShutdown()
+		}
+	}
+}
+
+// checkPeer verifies the process connected is run by the same user as the server and, if Caller is given, runs
+// this executable.
+func (s *Server) checkPeer(c net.Conn) (peer, error) {
+	p, err := peerCredentials(c)
+
+	if err != nil {
+		return peer{}, fmt.Errorf("no peer credentials: %v", err)
+	}
+
+	if p.uid != os.Getuid() {
+		return peer{}, fmt.Errorf("caller uid %d, agent uid %d", p.uid, os.Getuid())
+	}
+
+	if len(s.Caller) > 0 && !sameFile(p.exe, s.Caller) {
+		return peer{}, fmt.Errorf("caller %q is not %s", p.exe, s.Caller)
+	}
+
+	return p, nil
+}
+
+// confirm asks the user whether the process may use the key the request asks for, if the server asks for
+// confirmation. Requests not using a key and requests Handle refuses anyway are not asked for.
+func (s *Server) confirm(p peer, request Message) StatusCode {
+	if s.Confirm == nil || request.Version != Version || !request.Type.usesKey() {
+		return StatusOK
+	}
+
+	store, _, err := decodeStore(request.Payload)
+
+	if err != nil {
+		return StatusOK
+	}
+
+	// the terminal or the helper could only ask one question at a time
+	s.confirmMutex.Lock()
+	defer s.confirmMutex.Unlock()
+
+	g := grant{pid: p.pid, store: store}
+
+	if s.granted(g) {
+		return StatusOK
+	}
+
+	err = s.Confirm(fmt.Sprintf("Allow %s to use the key of store %s?", p, store))
+
+	switch err {
+	case nil:
+		log.Printf("Confirmed %s the key of store %s", p, store)
+	case ErrConfirmTimeout:
+		log.Printf("Confirmation for %s timed out", p)
+		return StatusConfirmTimeout
+	default:
+		log.Printf("Denied %s the key of store %s: %v", p, store, err)
+		return StatusDenied
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if p.pid > 0 && s.ConfirmGrace > 0 {
+		s.grants[g] = time.Now().Add(s.ConfirmGrace)
+	}
+
+	return StatusOK
+}
+
+// granted tells whether the grant covers the request without asking. That is the case if the confirmation given
+// has not lapsed yet, it is extended then, or if there is no key to use at all.
+func (s *Server) granted(g grant) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, status := s.lookup(g.store); status != StatusOK {
+		return true
+	}
+
+	now := time.Now()
+
+	for held, until := range s.grants {
+		if now.After(until) {
+			delete(s.grants, held)
+		}
+	}
+
+	if _, ok := s.grants[g]; ok {
+		s.grants[g] = now.Add(s.ConfirmGrace)
+		return true
+	}
+
+	return false
+}
+
+// sameFile tells whether both paths lead to the same file, symlinks followed.
+func sameFile(a string, b string) bool {
+	ai, err := os.Stat(a)
+
+	if err != nil {
+		return false
+	}
+
+	bi, err := os.Stat(b)
+
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// Handle answers a single request.
+func (s *Server) Handle(request Message) Message {
+	response := Message{Version: Version, Type: request.Type, Status: StatusOK}
+
+	if request.Version != Version {
+		response.Status = StatusUnsupportedVersion
+		return response
+	}
+
+	log.Printf("Request: %d", request.Type)
+
+	switch request.Type {
+	case Ping:
+	case GetKey:
+		store, _, err := decodeStore(request.Payload)
+
+		if err != nil {
+			response.Status = StatusBadRequest
+			break
+		}
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		key, status := s.lookup(store)
+
+		if status == StatusOK && s.Sealed {
+			status = StatusSealed
+		}
+
+		if status != StatusOK {
+			response.Status = status
+			break
+		}
+
+		s.lastUse = time.Now()
+		response.Payload = append([]byte{}, key.Buffer()...)
+	case Encrypt, Decrypt:
+		response.Payload, response.Status = s.crypt(request)
+	case Lock:
+		if len(request.Payload) == 0 {
+			s.Wipe()
+			break
+		}
+
+		store, _, err := decodeStore(request.Payload)
+
+		if err != nil {
+			response.Status = StatusBadRequest
+			break
+		}
+
+		s.forget(store)
+	case Shutdown:
+		s.Wipe()
+	case GetStatus:
+		payload, err := s.Status().encode()
+
+		if err != nil {
+			response.Status = StatusError
+			break
+		}
+
+		response.Payload = payload
+	case UpdateKey:
+		store, key, err := decodeStore(request.Payload)
+
+		if err != nil || len(key) != config.KeyLength {
+			response.Status = StatusBadRequest
+			break
+		}
+
+		if err := s.setKey(store, key); err != nil {
+			log.Printf("Error storing key: %v", err)
+			response.Status = StatusError
+		}
+	default:
+		response.Status = StatusBadRequest
+	}
+
+	return response
+}
+
+// crypt encrypts or decrypts the data of the crypto request with the key of the store. Data failing to decrypt is
+// answered with StatusError, it is not logged since clients probe records with the key.
+func (s *Server) crypt(request Message) ([]byte, StatusCode) {
+	store, payload, err := decodeStore(request.Payload)
+
+	if err != nil {
+		log.Printf("Invalid crypto request: %v", err)
+		return nil, StatusBadRequest
+	}
+
+	c, data, additionalData, err := decodeCryptoRequest(payload)
+
+	if err != nil {
+		log.Printf("Invalid crypto request: %v", err)
+		return nil, StatusBadRequest
+	}
+
+	e, err := crypto.NewEngineForCipher(c)
+
+	if err != nil {
+		log.Printf("Invalid crypto request: %v", err)
+		return nil, StatusBadRequest
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, status := s.lookup(store)
+
+	if status != StatusOK {
+		return nil, status
+	}
+
+	s.lastUse = time.Now()
+
+	var result []byte
+
+	if request.Type == Encrypt {
+		result, err = e.Encrypt(data, key.Buffer(), additionalData)
+	} else {
+		result, err = e.Decrypt(data, key.Buffer(), additionalData)
+	}
+
+	if err != nil {
+		return nil, StatusError
+	}
+
+	return result, StatusOK
+}
+
+// Status returns the current state of the server.
+func (s *Server) Status() Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := Status{Locked: len(s.keys) == 0, Sealed: s.Sealed, Confirm: s.Confirm != nil, PID: os.Getpid(), Started: s.started}
+
+	for store := range s.keys {
+		status.Stores = append(status.Stores, store)
+	}
+
+	sort.Slice(status.Stores, func(i, j int) bool {
+		if status.Stores[i].ID != status.Stores[j].ID {
+			return status.Stores[i].ID < status.Stores[j].ID
+		}
+
+		return status.Stores[i].Generation < status.Stores[j].Generation
+	})
+
+	if s.idleTimeout > 0 {
+		status.IdleDeadline = s.lastUse.Add(s.idleTimeout)
+	}
+
+	if s.maxLifetime > 0 {
+		status.EndOfLife = s.started.Add(s.maxLifetime)
+	}
+
+	return status
+}
+
+// Expired returns why the server should stop at the given time, an empty string as long as it should not.
+func (s *Server) Expired(now time.Time) string {
+	status := s.Status()
+
+	if !status.IdleDeadline.IsZero() && now.After(status.IdleDeadline) {
+		return "Idle timeout expired"
+	}
+
+	if !status.EndOfLife.IsZero() && now.After(status.EndOfLife) {
+		return "Maximum lifetime expired"
+	}
+
+	return ""
+}
+
+// Wipe destroys all keys, the server is locked afterwards.
+func (s *Server) Wipe() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for store, key := range s.keys {
+		key.Destroy()
+		delete(s.keys, store)
+	}
+
+	for g := range s.grants {
+		delete(s.grants, g)
+	}
+}
+
+// forget destroys the key of the store, whatever its generation.
+func (s *Server) forget(store Store) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for held, key := range s.keys {
+		if held.ID == store.ID {
+			log.Printf("Forgetting key of store %s", held)
+			key.Destroy()
+			delete(s.keys, held)
+		}
+	}
+
+	for g := range s.grants {
+		if g.store.ID == store.ID {
+			delete(s.grants, g)
+		}
+	}
+}
+
+// lookup returns the key of the store. A store asked for with a newer generation than the one held was rekeyed, the
+// stale key is evicted then. The mutex has to be held.
+func (s *Server) lookup(store Store) (*memguard.LockedBuffer, StatusCode) {
+	if len(s.keys) == 0 {
+		return nil, StatusLocked
+	}
+
+	if key, ok := s.keys[store]; ok {
+		return key, StatusOK
+	}
+
+	s.evict(store)
+	return nil, StatusUnknownStore
+}
+
+// evict destroys the keys of the older generations of the store. The mutex has to be held.
+func (s *Server) evict(store Store) {
+	for held, key := range s.keys {
+		if held.ID == store.ID && held.Generation < store.Generation {
+			log.Printf("Evicting stale key of store %s", held)
+			key.Destroy()
+			delete(s.keys, held)
+		}
+	}
+}
+
+// setKey replaces the key of the store, evicts older generations and restarts the idle timeout.
+func (s *Server) setKey(store Store, key []byte) error {
+	buffer, err := memguard.NewImmutableFromBytes(key)
+
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.evict(store)
+
+	if old, ok := s.keys[store]; ok {
+		old.Destroy()
+	}
+
+	s.keys[store] = buffer
+	s.lastUse = time.Now()
+	return nil
+}
@@ -3,22 +3,43 @@ package main
 import (
 	"bufio"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/awnumar/memguard"
 	"log"
+	"loki/agent"
 	"loki/config"
-	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"syscall"
+	"time"
 )
 
-var masterkey *memguard.LockedBuffer
-
 func main() {
-	setupLogging()
+	idleTimeout := flag.Duration("idle", config.DefaultIdleTimeout, "Exit when the key was not requested for this long, 0 disables.")
+	maxLifetime := flag.Duration("lifetime", config.DefaultMaxLifetime, "Exit after this time in any case, 0 disables.")
+	caller := flag.String("caller", "", "Only answer processes running this executable.")
+	sealed := flag.Bool("sealed", false, "Never hand out the key, encrypt and decrypt on request instead.")
+	confirm := flag.Bool("confirm", false, "Ask on the terminal before a key is handed out or used.")
+	confirmHelper := flag.String("confirm-helper", "", "Ask this program instead of the terminal, implies -confirm.")
+	confirmGrace := flag.Duration("confirm-grace", 0, "A confirmation covers further requests of the same process for this long, 0 asks every time.")
+	storeID := flag.String("store", "", "The ID of the store the key passed on stdin belongs to.")
+	generation := flag.Uint("generation", 0, "The generation of the key passed on stdin.")
+	flag.StringVar(&socketFile, "socket", config.DefaultSocketfilePath(), "The socket to listen on.")
+	logFile := flag.String("log", config.DefaultAgentLogfilePath(), "The file to log to.")
+	flag.Parse()
+
+	setupLogging(*logFile)
+
+	if len(*caller) > 0 && !agent.CallerCheckSupported {
+		log.Fatalf("Refusing to start: -caller is not supported on %s, the executable of clients is unknown", runtime.GOOS)
+	}
 
-	socketFile := config.GetSocketfilePath()
+	if err := agent.PrivateDir(filepath.Dir(socketFile)); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
 
 	log.Printf("Starting key server on file: %s\n", socketFile)
 
@@ -28,52 +49,91 @@ func main() {
 		panic(err)
 	}
 
-	masterkey, err = memguard.NewMutableFromBytes(key)
+	store := agent.Store{ID: *storeID, Generation: uint32(*generation)}
+	server, err := agent.NewServer(store, key, *idleTimeout, *maxLifetime)
 
 	if err != nil {
 		panic(err)
 	}
 
+	server.Caller = *caller
+	server.Sealed = *sealed
+	server.ConfirmGrace = *confirmGrace
+
+	if len(*confirmHelper) > 0 {
+		server.Confirm = agent.ConfirmWithHelper(*confirmHelper)
+	} else if *confirm {
+		// taking the foreground of the terminal from the background is allowed with SIGTTOU ignored only
+		signal.Ignore(syscall.SIGTTOU)
+		server.Confirm = agent.ConfirmOnTerminal
+	}
+	server.OnShutdown = func() {
+		log.Println("Shutting down on request")
+		shutdown()
+	}
+
+	// only a socket nobody listens on is removed, a running agent keeps its socket and its keys reachable
 	if _, err := os.Stat(socketFile); err == nil {
+		if err := agent.NewClient(socketFile).Ping(); err != agent.ErrNotListening {
+			log.Fatalf("Refusing to start, the socket %s is in use", socketFile)
+		}
+
+		log.Printf("Removing stale socketfile.")
 		os.Remove(socketFile)
 	}
 
-	ln, err := net.Listen("unix", socketFile)
+	ln, err := agent.Listen(socketFile)
 	if err != nil {
 		log.Fatal("Listen error: ", err)
 	}
 
-	// setting the correct permissions to the socket file
-	if err := os.Chmod(socketFile, 0700); err != nil {
-		log.Fatal("Error setting filemode: ", err)
-	}
-
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
-	go func(ln net.Listener, c chan os.Signal) {
+	go func(c chan os.Signal) {
 		sig := <-c
 		log.Printf("Caught signal %s: shutting down.", sig)
-		ln.Close()
-		os.Exit(0)
-	}(ln, sigc)
-
-	for {
-		log.Printf("Accepting connections")
-		fd, err := ln.Accept()
-		if err != nil {
-			log.Fatal("Accept error: ", err)
+		shutdown()
+	}(sigc)
+
+	log.Printf("Idle timeout: %s, maximum lifetime: %s, caller: %q, sealed: %t, confirm: %t, helper: %q, grace: %s", *idleTimeout,
+		*maxLifetime, *caller, *sealed, server.Confirm != nil, *confirmHelper, *confirmGrace)
+	log.Printf("Holding the key of store %s", store)
+
+	go func() {
+		for now := range time.Tick(time.Second) {
+			if reason := server.Expired(now); len(reason) > 0 {
+				log.Printf("%s: shutting down.", reason)
+				shutdown()
+			}
 		}
+	}()
 
-		go keyServer(fd)
-	}
+	log.Printf("Accepting connections, protocol version %d", agent.Version)
+	log.Fatal("Accept error: ", server.Serve(ln))
+}
+
+// socketFile is removed on shutdown.
+var socketFile string
+
+// shutdown wipes the masterkey, removes the socket and exits.
+func shutdown() {
+	memguard.DestroyAll()
+	os.Remove(socketFile)
+	os.Exit(0)
 }
 
-func setupLogging() {
-	f, err := os.OpenFile(config.AgentLogfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// setupLogging appends to the logfile, which is readable by the user only just like its directory.
+func setupLogging(logFile string) {
+	if err := agent.PrivateDir(filepath.Dir(logFile)); err != nil {
+		fmt.Fprintf(os.Stderr, "Refusing to log: %v\n", err)
+		os.Exit(1)
+	}
+
+	f, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error opening file: %v", err)
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Error opening logfile: %v\n", err)
+		os.Exit(1)
 	}
 	log.SetOutput(f)
 }
@@ -92,30 +152,3 @@ func readSecretFromStdin() ([]byte, error) {
 	}
 	return data, nil
 }
-
-func keyServer(c net.Conn) {
-
-	buf := make([]byte, 512)
-	nr, err := c.Read(buf)
-
-	if err != nil {
-		log.Fatal("Read error: ", err)
-		return
-	}
-
-	request := string(buf[0:nr])
-	log.Println("Server got:", request)
-
-	if request == config.RequestMagic {
-		c.Write(masterkey.Buffer())
-	} else if request == config.ShutdownMagic {
-		log.Println("Shutting down on request")
-		c.Close()
-		os.Remove(config.GetSocketfilePath())
-		os.Exit(0)
-	} else {
-		log.Println("Bouncing request")
-		c.Write([]byte("go away."))
-	}
-
-}
@@ -7,6 +7,17 @@ _loki_complete_entries () {
 	autoexpand=${1:-0}
 
 	local IFS=$'\n'
+
+	# stores with hidden names keep them in the encrypted index, only loki itself could list them
+	if [[ -f ${prefix}.index ]]; then
+		local names=($(compgen -W "$(loki -l off names 2>/dev/null)" -- "$cur"))
+		COMPREPLY+=("${names[@]}")
+		if [[ ${#names[@]} -gt 1 || ${names[0]} == */ ]]; then
+			compopt -o nospace
+		fi
+		return
+	fi
+
 	local items=($(compgen -f $prefix$cur))
 
 	# Remember the value of the first item, to see if it is a directory. If
@@ -70,18 +81,22 @@ _loki()
 {
 	COMPREPLY=()
 	local cur="${COMP_WORDS[COMP_CWORD]}"
-	local commands="search grep shutdown stop insert add login pw pass help ls list show import init change edit remove rm del copy cp move mv version ver complete"
+	local commands="search grep shutdown stop insert add login pw pass help ls list show import init change edit remove rm del copy cp move mv version ver complete agent kdf upgrade recipients otp expiring history restore-password attach detach extract"
 	if [[ $COMP_CWORD -gt 1 ]]; then
 		local lastarg="${COMP_WORDS[$COMP_CWORD-1]}"
 		case "${COMP_WORDS[1]}" in
-			ls|list|edit)
+			edit)
 				_loki_complete_entries
 				;;
 			show|-*)
 				_loki_complete_entries 1
 				;;
-			insert|add)
-				_loki_complete_entries
+			insert|add|ls|list)
+				if [[ $lastarg == --type ]]; then
+					COMPREPLY+=($(compgen -W "login card ssh note identity" -- ${cur}))
+				else
+					_loki_complete_entries
+				fi
 				;;
 			cp|copy|mv|rename)
 				_loki_complete_entries
@@ -89,6 +104,29 @@ _loki()
 			rm|remove|delete)
 				_loki_complete_entries
 				;;
+			otp|history|restore-password|detach)
+				_loki_complete_entries 1
+				;;
+			attach|extract)
+				if [[ $COMP_CWORD -eq 2 ]]; then
+					_loki_complete_entries 1
+				else
+					COMPREPLY+=($(compgen -f -- ${cur}))
+				fi
+				;;
+			agent)
+				COMPREPLY+=($(compgen -W "status lock unlock" -- ${cur}))
+				;;
+			kdf)
+				COMPREPLY+=($(compgen -W "calibrate" -- ${cur}))
+				;;
+			recipients)
+				if [[ $COMP_CWORD -eq 2 ]]; then
+					COMPREPLY+=($(compgen -W "identity list add remove" -- ${cur}))
+				elif [[ $COMP_CWORD -eq 3 ]]; then
+					_loki_complete_folders
+				fi
+				;;
 			git)
 				COMPREPLY+=($(compgen -W "init push pull config log reflog rebase" -- ${cur}))
 				;;
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"loki/agent"
+	"loki/config"
+	"loki/log"
+	"loki/subcommand"
+	"loki/utils"
+	"time"
+)
+
+// Agent inspects and controls the agent running in the background:
+// loki agent status
+// loki agent lock
+// loki agent unlock
+func Agent(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	if len(args) > 1 {
+		return errors.New("Too many arguments given")
+	}
+
+	switch args[0] {
+	case "status":
+		return agentStatus(cfg)
+	case "lock":
+		return lockAgent()
+	case "unlock":
+		return unlockAgent(cfg)
+	}
+
+	return fmt.Errorf("Unknown agent subcommand: %s", args[0])
+}
+
+// agentStatus shows the process of the agent, the stores it holds keys for and how long it keeps running.
+func agentStatus(cfg config.Configuration) error {
+	status, err := utils.QueryAgent()
+
+	if err != nil {
+		log.Debug("No status from agent: %v", err)
+		log.Info("No agent running.")
+		return nil
+	}
+
+	now := time.Now()
+
+	log.Info("PID          : %d", status.PID)
+	log.Info("Started      : %s, up %v", status.Started.Format(config.TimeFormat), now.Sub(status.Started).Round(time.Second))
+
+	if status.Sealed {
+		log.Info("Mode         : sealed, keys are never handed out")
+	}
+
+	if status.Confirm {
+		log.Info("Mode         : every use of a key has to be confirmed")
+	}
+
+	if status.Locked {
+		log.Info("Stores       : none, locked")
+	} else {
+		log.Info("Stores       : %d", len(status.Stores))
+	}
+
+	for _, store := range status.Stores {
+		log.Info("               %s%s", store, currentStoreMark(cfg, store))
+	}
+
+	log.Info("Idle timeout : %s", timeLeft(status.IdleDeadline, now))
+	log.Info("End of life  : %s", timeLeft(status.EndOfLife, now))
+	return nil
+}
+
+// currentStoreMark marks the store of cfg in the list of stores held by the agent.
+func currentStoreMark(cfg config.Configuration, store agent.Store) string {
+	if store.ID != cfg.StoreID {
+		return ""
+	}
+
+	if store.Generation != cfg.Generation {
+		return " (this store, stale generation)"
+	}
+
+	return " (this store)"
+}
+
+// timeLeft formats a deadline of the agent along with the time left until then.
+func timeLeft(deadline time.Time, now time.Time) string {
+	if deadline.IsZero() {
+		return "disabled"
+	}
+
+	return fmt.Sprintf("%s, %v left", deadline.Format(config.TimeFormat), deadline.Sub(now).Round(time.Second))
+}
+
+// lockAgent wipes the keys of all stores, the agent keeps running until it expires or is unlocked again.
+func lockAgent() error {
+	if err := utils.LockAgent(); err != nil {
+		log.Debug("Locking agent failed: %v", err)
+		log.Info("No agent running.")
+		return nil
+	}
+
+	log.Info("Agent locked, all keys wiped.")
+	return nil
+}
+
+// unlockAgent prompts for the password of the store and passes the key to the agent, which is started if need be.
+func unlockAgent(cfg config.Configuration) error {
+	// the status tells without asking for the key, which might have to be confirmed
+	if utils.AgentHoldsKey(cfg) {
+		log.Info("Agent holds the key of this store already.")
+		return nil
+	}
+
+	key, err := utils.GetMasterkeyWithAgent(cfg, false, false)
+
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		log.Info("Unlocked with your identity, no key for the agent.")
+		return nil
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	showSession()
+	return nil
+}
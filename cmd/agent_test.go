@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"loki/utils"
+	"testing"
+)
+
+func TestAgentLock(t *testing.T) {
+	defer SetupTest(t)()
+
+	if err := Agent(cfg, cmd, "status"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Agent(cfg, cmd, "lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the other tests rely on the agent holding the key
+	defer utils.SetupKeyAgentWithBinpath(cfg, testKey(), "../bin")
+
+	status, err := utils.QueryAgent()
+
+	if err != nil || !status.Locked || len(status.Stores) != 0 {
+		t.Errorf("agent not locked: %+v, %v", status, err)
+	}
+
+	if key, err := utils.GetMasterkeyFromAgent(cfg); err == nil || key != nil {
+		t.Error("key handed out by locked agent")
+	}
+}
+
+func TestAgentUnknownSubcommand(t *testing.T) {
+	if err := Agent(cfg, cmd, "open"); err == nil {
+		t.Error("unknown subcommand accepted")
+	}
+}
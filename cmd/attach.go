@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"loki/config"
+	"loki/log"
+	"loki/record"
+	"loki/storage"
+	"loki/subcommand"
+	"loki/utils"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Attach stores a file inside a record. The attachment is named like the file unless --name is given, an
+// attachment of the same name is replaced. The MIME type is guessed from the extension or the content.
+func Attach(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	flags := flag.NewFlagSet("attach", flag.ContinueOnError)
+	name := flags.String("name", "", "Name of the attachment, the name of the file by default.")
+	mimeType := flags.String("type", "", "MIME type of the attachment, guessed by default.")
+
+	args, err := parseInterspersed(flags, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		return errors.New("Record and file needed")
+	}
+
+	data, err := readAttachment(args[1])
+
+	if err != nil {
+		return err
+	}
+
+	if len(*name) == 0 {
+		*name = filepath.Base(args[1])
+	}
+
+	if len(*mimeType) == 0 {
+		if *mimeType = mime.TypeByExtension(filepath.Ext(args[1])); len(*mimeType) == 0 {
+			*mimeType = http.DetectContentType(data)
+		}
+	}
+
+	key, rec, filename, err := loadNamedRecord(cfg, args[0])
+
+	if err != nil {
+		return err
+	}
+
+	if attachment := rec.Attachment(*name); attachment != nil {
+		attachment.MimeType, attachment.Data = *mimeType, data
+		log.Info("Replacing attachment %s.", *name)
+	} else {
+		rec.Attachments = append(rec.Attachments, &storage.Attachment{Name: *name, MimeType: *mimeType, Data: data})
+	}
+
+	if err := record.WriteRecord(filename, cfg.Generation, key, rec); err != nil {
+		return err
+	}
+
+	log.Info("Attached %s (%s, %d bytes) to %s.", *name, *mimeType, len(data), args[0])
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// Detach removes the attachment with the given name from a record.
+func Detach(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	if len(args) != 2 {
+		return errors.New("Record and name of the attachment needed")
+	}
+
+	key, rec, filename, err := loadNamedRecord(cfg, args[0])
+
+	if err != nil {
+		return err
+	}
+
+	kept := []*storage.Attachment{}
+
+	for _, attachment := range rec.Attachments {
+		if attachment.Name != args[1] {
+			kept = append(kept, attachment)
+		}
+	}
+
+	if len(kept) == len(rec.Attachments) {
+		return errors.New("No attachment " + args[1] + " in record " + args[0])
+	}
+
+	rec.Attachments = kept
+
+	if err := record.WriteRecord(filename, cfg.Generation, key, rec); err != nil {
+		return err
+	}
+
+	log.Info("Removed attachment %s from %s.", args[1], args[0])
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// Extract writes the attachment with the given name to the file given with -o, only readable by the user, or
+// to stdout.
+func Extract(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	flags := flag.NewFlagSet("extract", flag.ContinueOnError)
+	output := flags.String("o", "", "File the attachment is written to, stdout by default.")
+
+	args, err := parseInterspersed(flags, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		return errors.New("Record and name of the attachment needed")
+	}
+
+	key, rec, _, err := loadNamedRecord(cfg, args[0])
+
+	if err != nil {
+		return err
+	}
+
+	attachment := rec.Attachment(args[1])
+
+	if attachment == nil {
+		return errors.New("No attachment " + args[1] + " in record " + args[0])
+	}
+
+	if len(*output) == 0 {
+		if _, err := os.Stdout.Write(attachment.Data); err != nil {
+			return err
+		}
+	} else {
+		if err := writePrivateFile(*output, attachment.Data); err != nil {
+			return err
+		}
+
+		log.Info("Extracted %s (%d bytes) to %s.", attachment.Name, len(attachment.Data), *output)
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// writePrivateFile writes data to the file given with path, readable by the user only. An existing file is made
+// private before the data is written, its permissions could be wider.
+func writePrivateFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// readAttachment reads the file to attach, files exceeding the size limit of records are refused before they
+// are read completely.
+func readAttachment(path string) ([]byte, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, record.MaxRecordSize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > record.MaxRecordSize {
+		return nil, fmt.Errorf("%s too large, records are limited to %d bytes", path, record.MaxRecordSize)
+	}
+
+	return data, nil
+}
+
+// parseInterspersed parses the flags given before, between or after the arguments and returns the arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"loki/record"
+	"loki/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttachments(t *testing.T) {
+	defer SetupTest(t)()
+
+	filename := TBASE() + "cluster.loki"
+
+	if err := record.WriteRecord(filename, cfg.Generation, testKey(), &storage.Record{Title: "cluster"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "loki-attach")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	data := []byte{0x00, 0x01, 0xfe, 0xff, 'k', 'u', 'b', 'e'}
+	source := filepath.Join(dir, "kubeconfig.yaml")
+
+	if err := ioutil.WriteFile(source, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Attach(cfg, cmd, "cluster", source); err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing file readable by others is made private
+	target := filepath.Join(dir, "extracted")
+
+	if err := ioutil.WriteFile(target, []byte("public"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Extract(cfg, cmd, "cluster", "kubeconfig.yaml", "-o", target); err != nil {
+		t.Fatal(err)
+	}
+
+	if extracted, err := ioutil.ReadFile(target); err != nil || !bytes.Equal(extracted, data) {
+		t.Errorf("extracted %x, expected %x: %v", extracted, data, err)
+	}
+
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("extracted file accessible by others: %v", info.Mode())
+	}
+
+	if err := Extract(cfg, cmd, "cluster", "missing"); err == nil {
+		t.Error("missing attachment extracted")
+	}
+
+	if err := Detach(cfg, cmd, "cluster", "kubeconfig.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec, _, err := record.LoadRecord(filename, testKey()); err != nil || len(rec.Attachments) != 0 {
+		t.Errorf("attachment not removed: %v", err)
+	}
+
+	if err := Detach(cfg, cmd, "cluster", "kubeconfig.yaml"); err == nil {
+		t.Error("missing attachment removed")
+	}
+}
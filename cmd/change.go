@@ -4,14 +4,17 @@ import (
 	"errors"
 	"fmt"
 	"loki/config"
+	"loki/crypto"
 	"loki/log"
 	"loki/record"
 	"loki/subcommand"
 	"loki/tree"
 	"loki/utils"
+	"os"
 )
 
 // ChangeMasterkey changes the password for all files in the store. This modifies all every single file plus the .master file.
+// A new salt is generated for the key derivation, legacy stores are moved to the current KDF on the way.
 func ChangeMasterkey(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
 
 	if len(args) > 0 {
@@ -21,28 +24,35 @@ func ChangeMasterkey(cfg config.Configuration, subcommand subcommand.Subcommand,
 	log.Info("Change Masterkey.")
 
 	base := cfg.SystemDirectory()
-	oldgeneration := cfg.Generation
 
 	if !utils.CheckBase(cfg) {
 		return fmt.Errorf("Problem getting basedir")
 	}
 
-	// Stop Agent
-	utils.ShutdownAgent()
+	// The agent must not hand out the old key any more, keys of other stores are kept
+	utils.ForgetAgentKey(cfg)
 
 	// Verify old key
 
 	log.Info("Please provide the old password for verification.")
 
-	oldkey, err := utils.GetMasterkeyWithAgent(false, false)
+	oldkey, err := utils.GetMasterkeyWithAgent(cfg, false, false)
 
 	if err != nil {
 		return err
 	}
 
+	if oldkey == nil {
+		return errors.New("the masterpassword is needed to change it")
+	}
+
 	// generate map of all files:
 
-	fm := tree.CreateFilemap(base, oldkey)
+	fm, err := masterkeyFilemap(base, oldkey)
+
+	if err != nil {
+		return err
+	}
 
 	items := len(*fm)
 
@@ -53,23 +63,111 @@ func ChangeMasterkey(cfg config.Configuration, subcommand subcommand.Subcommand,
 
 	log.Info("Found %d items to change:\n", items)
 
+	params, err := renewKDFParameters(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	kdf, err := utils.StoreKeyDerivator(cfg, params)
+
+	if err != nil {
+		return err
+	}
+
 	// Request new key twice
 	log.Info("Please provide the NEW password.")
-	newkey, _ := utils.GetMasterkeyWithAgent(true, false)
+	newkey, err := utils.PromptMasterkey(kdf, true)
+
+	if err != nil {
+		return err
+	}
+
+	return rekeyStore(cfg, fm, oldkey, newkey, params)
+}
+
+// masterkeyFilemap maps all records below dir protected by the masterkey, which all have to decrypt with the key.
+// Records written by recipients without the masterpassword are skipped, they have no masterkey wrap to renew.
+func masterkeyFilemap(dir string, key crypto.Key) (*tree.FileMap, error) {
+	fm := make(tree.FileMap)
+	var failed error
+
+	tree.FilteredWalk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		protected, err := record.CheckKey(path, key)
+
+		if err == nil && !protected {
+			log.Debug("Not protected by the masterkey: %s", path)
+			return nil
+		}
+
+		rec, _, err := record.LoadRecord(path, key)
+
+		if err != nil {
+			failed = fmt.Errorf("unable to decrypt %s: %v", path, err)
+			return failed
+		}
+
+		fm[path] = rec
+		return nil
+	})
+
+	return &fm, failed
+}
+
+// rekeyStore re-wraps the data keys of all records of the filemap with the new key using the next generation
+// and records the KDF parameters the new key was derived with in the masterfile.
+func rekeyStore(cfg config.Configuration, fm *tree.FileMap, oldkey crypto.Key, newkey crypto.Key, params crypto.KDFParameters) error {
 
 	// Changes all files
-	for k, v := range *fm {
-		log.Debug("key[%s] value[%s]\n", k, v)
-		record.WriteRecord(k, oldgeneration+1, newkey, *v)
+	for k := range *fm {
+		log.Debug("key[%s]\n", k)
+
+		if err := record.ChangeKey(k, cfg.Generation+1, oldkey, newkey); err != nil {
+			return err
+		}
+	}
+
+	// The index of hidden names is encrypted with the masterkey as well
+	if ix, err := openIndex(cfg, oldkey); err != nil {
+		return err
+	} else if err := saveIndex(ix, newkey); err != nil {
+		return err
 	}
 
 	// Update Masterfile to indicate global change
-	utils.RaiseGenerationInMasterfile(cfg.GetMasterfilename())
+	if err := utils.RaiseGenerationWithKDFInMasterfile(cfg.GetMasterfilename(), params, newkey); err != nil {
+		return err
+	}
 
 	// Verify all files
-	if err := tree.Verify(base, newkey); err != nil {
+	if err := tree.Verify(cfg.SystemDirectory(), newkey); err != nil {
 		log.Error("Tree verification failed: %v", err)
 	}
 
 	return nil
 }
+
+// renewKDFParameters keeps the costs and the keyfile requirement of the store but creates a fresh salt. Legacy
+// stores get the default costs.
+func renewKDFParameters(cfg config.Configuration) (crypto.KDFParameters, error) {
+	masterfile, err := utils.LoadMasterfile(cfg.GetMasterfilename())
+
+	if err != nil {
+		return crypto.KDFParameters{}, err
+	}
+
+	old := utils.KDFParametersFromMasterfile(masterfile)
+
+	if old.IsLegacy() {
+		return crypto.NewKDFParameters()
+	}
+
+	params, err := crypto.NewKDFParametersWithCosts(old.Time, old.Memory, old.Threads)
+	params.Keyfile = old.Keyfile
+
+	return params, err
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"loki/crypto"
+	"loki/record"
+	"loki/storage"
+	"loki/tree"
+	"testing"
+)
+
+func TestMasterkeyFilemap(t *testing.T) {
+	defer SetupTest(t)()
+	defer record.SetIdentityLoader(nil)
+
+	alice, _ := crypto.NewIdentity()
+
+	if err := Recipients(cfg, cmd, "add", "dir3", crypto.EncodePublicKey(alice.PublicKey), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// written by alice without the masterpassword
+	record.SetIdentityLoader(func() (*crypto.Identity, error) { return alice, nil })
+
+	if err := record.WriteRecord(TBASE()+"dir3"+SEP+"alice.loki", cfg.Generation, nil, &storage.Record{Title: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fm, err := masterkeyFilemap(TBASE(), testKey())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// alice's identity opens every record
+	all := tree.CreateFilemap(TBASE(), testKey())
+
+	if len(*fm) != len(*all)-1 {
+		t.Errorf("%d of %d records mapped", len(*fm), len(*all))
+	}
+
+	if _, ok := (*fm)[TBASE()+"dir3"+SEP+"alice.loki"]; ok {
+		t.Error("record of recipients only mapped")
+	}
+
+	if _, err := masterkeyFilemap(TBASE(), crypto.LocalKey(make([]byte, 32))); err == nil {
+		t.Error("records mapped with a wrong key")
+	}
+}
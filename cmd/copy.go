@@ -1,24 +1,32 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"loki/config"
+	"loki/crypto"
+	"loki/index"
 	"loki/log"
+	"loki/record"
 	"loki/subcommand"
+	"loki/tree"
 	"loki/utils"
 )
 
 // Copy copies a single pasword (*.loki) to a new location. Directory copies are not supported yet.
 func Copy(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
-	key, _ := utils.GetMasterkey(false)
+	key, err := utils.GetMasterkey(cfg, false)
 
-	if key == nil {
-		return errors.New("could not get Masterkey")
+	if err != nil {
+		return err
+	}
+
+	if cfg.HiddenNames {
+		return copyHidden(cfg, key, args[0], args[1])
 	}
 
 	// source is either:
@@ -82,6 +90,99 @@ func Copy(cfg config.Configuration, subcommand subcommand.Subcommand, args ...st
 		return fmt.Errorf("Error copying: %v", err)
 	}
 
-	utils.SetupKeyAgent(key)
+	if err := rewrapRecords(dst, key); err != nil {
+		return err
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// rewrapRecords wraps the data keys of the records at path, a record or a directory, for the recipients responsible
+// at their new location. A record copied or moved into a directory with other recipients would otherwise stay
+// readable by the recipients of its old directory only.
+func rewrapRecords(path string, key crypto.Key) error {
+	failed := 0
+
+	tree.FilteredWalk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		hdr, err := record.LoadHeader(name)
+
+		if err == nil {
+			err = record.ChangeKey(name, hdr.Generation, key, key)
+		}
+
+		if err != nil {
+			log.Error("Failed   : %s: %v", name, err)
+			failed++
+		}
+
+		return nil
+	})
+
+	if failed > 0 {
+		return fmt.Errorf("%d records could not be rewrapped for their new recipients", failed)
+	}
+
+	return nil
+}
+
+// copyHidden copies records of a store with hidden names. Every copy gets a new entry in the index and a file of
+// its own.
+func copyHidden(cfg config.Configuration, key crypto.Key, src string, dst string) error {
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
+		return err
+	}
+
+	copies := make(map[string]string)
+
+	if _, ok := ix.Lookup(src); ok {
+		if ix.IsDir(dst) {
+			dst = path.Join(index.Clean(dst), path.Base(index.Clean(src)))
+		}
+
+		copies[index.Clean(src)] = index.Clean(dst)
+	} else if names := ix.Below(src); len(names) > 0 {
+		if _, ok := ix.Lookup(dst); ok || strings.HasSuffix(dst, config.FileSuffix) {
+			return fmt.Errorf("Destination should be no filename when copying directories: %s -> %s", src, dst)
+		}
+
+		for _, name := range names {
+			copies[name] = path.Join(index.Clean(dst), strings.TrimPrefix(name, index.Clean(src)+"/"))
+		}
+	} else {
+		return fmt.Errorf("Could not find source: %s", src)
+	}
+
+	log.Info("Copying: %s -> %s", index.Clean(src), index.Clean(dst))
+
+	for from, to := range copies {
+		srcFile, err := recordFile(cfg, ix, from)
+
+		if err != nil {
+			return err
+		}
+
+		dstFile, err := newRecordFile(cfg, ix, to)
+
+		if err != nil {
+			return err
+		}
+
+		if err := utils.CopyFile(srcFile, dstFile); err != nil {
+			return fmt.Errorf("Error copying: %v", err)
+		}
+	}
+
+	if err := ix.Save(key); err != nil {
+		return err
+	}
+
+	utils.SetupKeyAgent(cfg, key)
 	return nil
 }
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"loki/crypto"
+	"loki/record"
 	"loki/utils"
 	"testing"
 )
@@ -56,3 +58,38 @@ func TestCopyCase4_dir_dir_exists(t *testing.T) {
 	}
 }
 */
+
+func TestCopyRecipients(t *testing.T) {
+	defer SetupTest(t)()
+	defer record.SetIdentityLoader(nil)
+
+	alice, _ := crypto.NewIdentity()
+
+	if err := Recipients(cfg, cmd, "add", "dir3", crypto.EncodePublicKey(alice.PublicKey), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	record.SetIdentityLoader(func() (*crypto.Identity, error) { return alice, nil })
+
+	// into the recipients directory: alice gets access
+	if err := Copy(cfg, cmd, "file1", "dir3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := record.LoadRecord(TBASE()+"dir3"+SEP+"file1.loki", nil); err != nil {
+		t.Errorf("recipient has no access to the copy: %v", err)
+	}
+
+	// and out of it again: alice loses access, the masterkey still opens it
+	if err := Copy(cfg, cmd, "dir3/sub/bingo", "dir1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := record.LoadRecord(TBASE()+"dir1"+SEP+"bingo.loki", nil); err == nil {
+		t.Error("recipient of the source has access to the copy")
+	}
+
+	if _, _, err := record.LoadRecord(TBASE()+"dir1"+SEP+"bingo.loki", testKey()); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"loki/config"
+	"loki/crypto"
 	"loki/log"
 	"loki/record"
 	pb "loki/storage"
@@ -24,7 +25,7 @@ func Diff(cfg config.Configuration, subcommand subcommand.Subcommand, args ...st
 		}
 	}
 
-	key, err := utils.GetMasterkey(false)
+	key, err := utils.GetMasterkey(cfg, false)
 
 	if err != nil {
 		return fmt.Errorf("no acces")
@@ -38,11 +39,11 @@ func Diff(cfg config.Configuration, subcommand subcommand.Subcommand, args ...st
 
 	log.Info(diff)
 
-	utils.SetupKeyAgent(key)
+	utils.SetupKeyAgent(cfg, key)
 	return nil
 }
 
-func diffFiles(oldpath, newpath string, key []byte) (string, error) {
+func diffFiles(oldpath, newpath string, key crypto.Key) (string, error) {
 
 	var old *pb.Record
 	var new *pb.Record
@@ -80,12 +81,13 @@ func diffRecords(old, new *pb.Record) string {
 		2: fieldDesc{"Password", config.PasswordLabel},
 		3: fieldDesc{"Url", config.URLLabel},
 		4: fieldDesc{"Notes", config.NotesLabel},
+		5: fieldDesc{"Otpauth", config.OTPLabel},
 	}
 
-	ov := reflect.ValueOf(*old)
-	nv := reflect.ValueOf(*new)
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(new).Elem()
 
-	for idx := range []int{0, 1, 2, 3, 4} {
+	for idx := range []int{0, 1, 2, 3, 4, 5} {
 
 		field := fields[idx].name
 		label := fields[idx].label
@@ -98,5 +100,119 @@ func diffRecords(old, new *pb.Record) string {
 			diff = diff + fmt.Sprintf("+"+label+"%s\n", nvalue)
 		}
 	}
+
+	if old.Expires != new.Expires {
+		diff = diff + fmt.Sprintf("-"+config.ExpiresLabel+"%s\n", pb.FormatDate(old.Expires))
+		diff = diff + fmt.Sprintf("+"+config.ExpiresLabel+"%s\n", pb.FormatDate(new.Expires))
+	}
+
+	return diff + diffTyped(old, new) + diffFields(old.Fields, new.Fields) + diffAttachments(old, new)
+}
+
+// diffAttachments compares the attachments by name, changed content is shown by size and md5sum only.
+func diffAttachments(old, new *pb.Record) string {
+	var diff string
+
+	describe := func(attachment *pb.Attachment) string {
+		return fmt.Sprintf("%s (%s, %d bytes, md5 %s)\n", attachment.Name, attachment.MimeType, len(attachment.Data),
+			utils.Hexdump(crypto.GetStringMD5(string(attachment.Data))))
+	}
+
+	for _, o := range old.Attachments {
+		if n := new.Attachment(o.Name); n == nil || describe(n) != describe(o) {
+			diff = diff + "-" + config.AttachmentLabel + describe(o)
+
+			if n != nil {
+				diff = diff + "+" + config.AttachmentLabel + describe(n)
+			}
+		}
+	}
+
+	for _, n := range new.Attachments {
+		if old.Attachment(n.Name) == nil {
+			diff = diff + "+" + config.AttachmentLabel + describe(n)
+		}
+	}
+
+	return diff
+}
+
+// diffTyped compares the type of the records and their type specific fields, matched by label.
+func diffTyped(old, new *pb.Record) string {
+	var diff string
+
+	if old.Type != new.Type {
+		diff = diff + fmt.Sprintf("-"+config.TypeLabel+"%s\n", old.Type.Name())
+		diff = diff + fmt.Sprintf("+"+config.TypeLabel+"%s\n", new.Type.Name())
+	}
+
+	if okey, nkey := old.GetSshKey().GetPrivateKey(), new.GetSshKey().GetPrivateKey(); okey != nkey {
+		diff = diff + fmt.Sprintf("-"+config.PrivateKeyLabel+"%s\n", okey)
+		diff = diff + fmt.Sprintf("+"+config.PrivateKeyLabel+"%s\n", nkey)
+	}
+
+	values := map[string]string{}
+
+	for _, field := range new.TypedFields() {
+		values[field.Label] = *field.Value
+	}
+
+	for _, field := range old.TypedFields() {
+		if nvalue, ok := values[field.Label]; !ok || nvalue != *field.Value {
+			diff = diff + fmt.Sprintf("-"+field.Label+"%s\n", *field.Value)
+
+			if ok {
+				diff = diff + fmt.Sprintf("+"+field.Label+"%s\n", nvalue)
+			}
+		}
+
+		delete(values, field.Label)
+	}
+
+	for _, field := range new.TypedFields() {
+		if nvalue, ok := values[field.Label]; ok {
+			diff = diff + fmt.Sprintf("+"+field.Label+"%s\n", nvalue)
+		}
+	}
+
+	return diff
+}
+
+// diffFields compares the custom fields by name, keeping the order of the old record first.
+func diffFields(old, new []*pb.Field) string {
+	var diff string
+
+	lookup := func(fields []*pb.Field, name string) *pb.Field {
+		for _, field := range fields {
+			if field.Name == name {
+				return field
+			}
+		}
+		return nil
+	}
+
+	format := func(field *pb.Field) string {
+		if field.Concealed {
+			return field.Label() + field.Value + " (concealed)\n"
+		}
+		return field.Label() + field.Value + "\n"
+	}
+
+	for _, o := range old {
+		n := lookup(new, o.Name)
+
+		if n == nil {
+			diff = diff + "-" + format(o)
+		} else if o.Value != n.Value || o.Concealed != n.Concealed {
+			diff = diff + "-" + format(o) + "+" + format(n)
+		}
+	}
+
+	for _, n := range new {
+		if lookup(old, n.Name) == nil {
+			diff = diff + "+" + format(n)
+		}
+	}
+
 	return diff
 }
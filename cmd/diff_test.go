@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	pb "loki/storage"
+	"testing"
+)
+
+func TestDiffFields(t *testing.T) {
+	old := &pb.Record{Title: "mail", Fields: []*pb.Field{
+		{Name: "PIN", Value: "1234", Concealed: true},
+		{Name: "Question", Value: "Pet"},
+	}}
+
+	new := &pb.Record{Title: "mail", Fields: []*pb.Field{
+		{Name: "PIN", Value: "4321", Concealed: true},
+		{Name: "Recovery", Value: "abc"},
+	}}
+
+	expected := "-PIN         : 1234 (concealed)\n" +
+		"+PIN         : 4321 (concealed)\n" +
+		"-Question    : Pet\n" +
+		"+Recovery    : abc\n"
+
+	if diff := diffRecords(old, new); diff != expected {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+
+	if diff := diffRecords(old, old); len(diff) > 0 {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+
+	if !new.Search("recov") || !old.Search("pet") || old.Search("recov") {
+		t.Error("fields not searched")
+	}
+}
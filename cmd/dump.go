@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"loki/config"
+	"loki/crypto"
 	"loki/log"
 	"loki/record"
 	"loki/subcommand"
@@ -22,16 +23,17 @@ func Dump(cfg config.Configuration, subcommand subcommand.Subcommand, args ...st
 		return errors.New("could not find basedir")
 	}
 
-	key := dumpWalker(base, cfg.Blindmode)
+	key := dumpWalker(cfg, base)
 
-	utils.SetupKeyAgent(key)
+	utils.SetupKeyAgent(cfg, key)
 
 	return nil
 }
 
-func dumpWalker(dir string, blind bool) []byte {
+func dumpWalker(cfg config.Configuration, dir string) crypto.Key {
 
-	var key []byte
+	var key crypto.Key
+	unlocked := false
 
 	tree.FilteredWalk(dir, func(path string, info os.FileInfo, err error) error {
 		if !info.IsDir() {
@@ -46,8 +48,13 @@ func dumpWalker(dir string, blind bool) []byte {
 			log.Info("Path: " + relPath)
 			log.Info("------------------------------------------------------------------------------")
 
-			if key == nil {
-				key, _ = utils.GetMasterkey(false)
+			if !unlocked {
+				if key, err = utils.GetMasterkey(cfg, false); err != nil {
+					log.Error("%v", err)
+					return err
+				}
+
+				unlocked = true
 			}
 
 			rec, hdr, err := record.LoadRecord(path, key)
@@ -61,7 +68,7 @@ func dumpWalker(dir string, blind bool) []byte {
 			hdr.Print(column)
 			log.Info("")
 
-			utils.PrefixedDisplay(rec, column, blind)
+			utils.PrefixedDisplay(rec, column, cfg.Blindmode)
 
 		}
 
@@ -11,9 +11,24 @@ import (
 // Edit lets you edit a single record ( lokifile ). You might use an external editor for the
 // Notes field by setting the EDITOR environment variable.
 func Edit(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
-	filename := utils.NormalizePath(args[0])
+	key, err := utils.GetMasterkey(cfg, false)
 
-	key, _ := utils.GetMasterkey(false)
+	if err != nil {
+		return err
+	}
+
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
+		return err
+	}
+
+	filename, err := recordFile(cfg, ix, args[0])
+
+	if err != nil {
+		log.Error("%v", err)
+		return err
+	}
 
 	rec, hdr, err := record.LoadRecord(filename, key)
 
@@ -41,9 +56,9 @@ func Edit(cfg config.Configuration, subcommand subcommand.Subcommand, args ...st
 		rec.Notes = notes
 	}
 
-	record.WriteRecord(filename, cfg.Generation, key, *rec)
+	record.WriteRecord(filename, cfg.Generation, key, rec)
 
-	utils.SetupKeyAgent(key)
+	utils.SetupKeyAgent(cfg, key)
 
 	return nil
 }
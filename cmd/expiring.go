@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"errors"
+	"loki/config"
+	"loki/crypto"
+	"loki/index"
+	"loki/log"
+	"loki/record"
+	"loki/storage"
+	"loki/subcommand"
+	"loki/utils"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultExpiringDays is the period looked ahead if no number of days is given.
+const defaultExpiringDays = 30
+
+// expiringRecord is one line of the expiring report.
+type expiringRecord struct {
+	name    string
+	expires int64
+}
+
+// Expiring reports all records which are expired or expire within the given number of days, 30 by default.
+func Expiring(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	days := defaultExpiringDays
+
+	if len(args) > 1 {
+		return errors.New("Too many arguments given")
+	}
+
+	if len(args) > 0 {
+		var err error
+
+		if days, err = strconv.Atoi(args[0]); err != nil || days < 0 {
+			return errors.New("Number of days expected: " + args[0])
+		}
+	}
+
+	key, err := utils.GetMasterkey(cfg, false)
+
+	if err != nil {
+		return err
+	}
+
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	expiring, err := collectExpiring(cfg, ix, key, now.AddDate(0, 0, days).Unix())
+
+	if err != nil {
+		return err
+	}
+
+	if len(expiring) == 0 {
+		log.Info("No records expiring within %d days.", days)
+	}
+
+	for _, e := range expiring {
+		left := int(time.Unix(e.expires, 0).Sub(now).Hours() / 24)
+
+		if e.expires <= now.Unix() {
+			log.Info("%s  %s  (expired)", storage.FormatDate(e.expires), e.name)
+		} else {
+			log.Info("%s  %s  (%d days left)", storage.FormatDate(e.expires), e.name, left)
+		}
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// collectExpiring returns the records expiring before limit, sorted by their expiry date.
+func collectExpiring(cfg config.Configuration, ix *index.Index, key crypto.Key, limit int64) ([]expiringRecord, error) {
+	expiring := []expiringRecord{}
+
+	err := walkRecords(cfg, ix, func(name string, filename string) error {
+		rec, _, err := record.LoadRecord(filename, key)
+
+		if err != nil {
+			log.Error("Error reading record. Name: %s, Error: %v", name, err)
+			return err
+		}
+
+		if rec.Expires > 0 && rec.Expires <= limit {
+			expiring = append(expiring, expiringRecord{name, rec.Expires})
+		}
+
+		return nil
+	})
+
+	sort.SliceStable(expiring, func(i, j int) bool { return expiring[i].expires < expiring[j].expires })
+	return expiring, err
+}
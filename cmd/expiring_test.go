@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"loki/record"
+	"loki/storage"
+	"testing"
+	"time"
+)
+
+func TestExpiring(t *testing.T) {
+	defer SetupTest(t)()
+
+	soon := storage.Record{Title: "soon", Expires: time.Now().AddDate(0, 0, 3).Unix()}
+
+	if err := record.WriteRecord(TBASE()+"soon.loki", cfg.Generation, testKey(), &soon); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Expiring(cfg, cmd, "7"); err != nil {
+		t.Error(err)
+	}
+
+	expiring, err := collectExpiring(cfg, nil, testKey(), time.Now().AddDate(0, 0, 7).Unix())
+
+	if err != nil || len(expiring) != 1 || expiring[0].name != "soon" {
+		t.Errorf("unexpected report: %v %v", expiring, err)
+	}
+
+	if expiring, _ := collectExpiring(cfg, nil, testKey(), time.Now().Unix()); len(expiring) != 0 {
+		t.Errorf("unexpected report: %v", expiring)
+	}
+
+	if err := Expiring(cfg, cmd, "soon"); err == nil {
+		t.Error("invalid number of days accepted")
+	}
+
+	if err := List(cfg, cmd, "--long"); err != nil {
+		t.Error(err)
+	}
+}
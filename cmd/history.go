@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"loki/config"
+	"loki/crypto"
+	"loki/log"
+	"loki/record"
+	pb "loki/storage"
+	"loki/subcommand"
+	"loki/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// History lists the earlier passwords of a record, the most recent first. The passwords are masked in Blindmode.
+func History(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	if len(args) > 1 {
+		return errors.New("Too many arguments given")
+	}
+
+	key, rec, _, err := loadNamedRecord(cfg, args[0])
+
+	if err != nil {
+		return err
+	}
+
+	if len(rec.History) == 0 {
+		log.Info("No earlier passwords.")
+	}
+
+	for i, entry := range rec.History {
+		password := entry.Password
+
+		if cfg.Blindmode {
+			password = config.SecretMask
+		}
+
+		log.Info("%2d  %s - %s  %s", i+1, formatHistoryTime(entry.Changed), formatHistoryTime(entry.Replaced), password)
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// RestorePassword makes the earlier password with the given number, as listed by history, the current password
+// again. The current password moves into the history.
+func RestorePassword(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	if len(args) != 2 {
+		return errors.New("Record and number of the password needed")
+	}
+
+	n, err := strconv.Atoi(args[1])
+
+	if err != nil {
+		return errors.New("Number of the password expected: " + args[1])
+	}
+
+	key, rec, filename, err := loadNamedRecord(cfg, args[0])
+
+	if err != nil {
+		return err
+	}
+
+	if n < 1 || n > len(rec.History) {
+		return fmt.Errorf("No earlier password %d, the record has %d", n, len(rec.History))
+	}
+
+	rec.Password = rec.History[n-1].Password
+	rec.History = append(rec.History[:n-1], rec.History[n:]...)
+
+	if err := record.WriteRecord(filename, cfg.Generation, key, rec); err != nil {
+		return err
+	}
+
+	log.Info("Restored password %d of %s.", n, args[0])
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// loadNamedRecord loads the record with the given name and returns it together with the key and its file.
+func loadNamedRecord(cfg config.Configuration, name string) (crypto.Key, *pb.Record, string, error) {
+	key, err := utils.GetMasterkey(cfg, false)
+
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	filename, err := recordFile(cfg, ix, name)
+
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	rec, _, err := record.LoadRecord(filename, key)
+
+	if err != nil {
+		log.Error("Error reading record: %v", err)
+		return nil, nil, "", err
+	}
+
+	return key, rec, filename, nil
+}
+
+func formatHistoryTime(unix int64) string {
+	if unix == 0 {
+		return strings.Repeat("?", len(config.TimeFormat))
+	}
+
+	return time.Unix(unix, 0).Format(config.TimeFormat)
+}
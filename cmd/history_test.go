@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"loki/record"
+	"loki/storage"
+	"testing"
+)
+
+func TestHistoryRestore(t *testing.T) {
+	defer SetupTest(t)()
+
+	filename := TBASE() + "history.loki"
+
+	for _, password := range []string{"first", "second", "third"} {
+		rec, _, err := record.LoadRecord(filename, testKey())
+
+		if err != nil {
+			rec = &storage.Record{Title: "history"}
+		}
+
+		rec.Password = password
+
+		if err := record.WriteRecord(filename, cfg.Generation, testKey(), rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := History(cfg, cmd, "history"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RestorePassword(cfg, cmd, "history", "3"); err == nil {
+		t.Error("unknown entry restored")
+	}
+
+	if err := RestorePassword(cfg, cmd, "history", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, _, err := record.LoadRecord(filename, testKey())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Password != "first" || len(rec.History) != 2 || rec.History[0].Password != "third" || rec.History[1].Password != "second" {
+		t.Errorf("unexpected history: %s %v", rec.Password, rec.History)
+	}
+}
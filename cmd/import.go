@@ -45,7 +45,7 @@ func Import(cfg config.Configuration, subcommand subcommand.Subcommand, args ...
 	   5 -> Notes
 	*/
 
-	var records = make(map[string]pb.Record)
+	var records = make(map[string]*pb.Record)
 
 	r := csv.NewReader(strings.NewReader(string(data)))
 
@@ -91,24 +91,46 @@ func Import(cfg config.Configuration, subcommand subcommand.Subcommand, args ...
 		tags := make([]string, 0)
 		tags = append(tags, "imported-"+nowAsString)
 
-		records[filename] = pb.Record{Title: title, Account: username, Password: password, Tags: tags, Url: url, Notes: notes}
+		records[filename] = &pb.Record{Title: title, Account: username, Password: password, Tags: tags, Url: url, Notes: notes}
 	}
 
 	cnt := len(records)
 
 	if cnt > 0 {
 		log.Info("\nImporting %d records\n", cnt)
-		key, _ := utils.GetMasterkey(true)
+		key, err := utils.GetMasterkey(cfg, true)
 
-		for filename, rec := range records {
-			utils.CreateLeadingDirectories(filename)
-			err := record.WriteRecord(filename, cfg.Generation, key, rec)
+		if err != nil {
+			return err
+		}
+
+		if err := utils.StoreKeyCheck(cfg.GetMasterfilename(), key); err != nil {
+			return err
+		}
+
+		ix, err := openIndex(cfg, key)
+
+		if err != nil {
+			return err
+		}
+
+		for name, rec := range records {
+			filename, err := newRecordFile(cfg, ix, name)
 
 			if err != nil {
 				return err
 			}
+
+			if err := record.WriteNewRecord(filename, cfg.Generation, key, rec); err != nil {
+				return err
+			}
 		}
-		utils.SetupKeyAgent(key)
+
+		if err := saveIndex(ix, key); err != nil {
+			return err
+		}
+
+		utils.SetupKeyAgent(cfg, key)
 	}
 
 	return nil
@@ -1,19 +1,55 @@
 package cmd
 
 import (
+	"errors"
+	"flag"
 	"loki/config"
+	"loki/crypto"
 	"loki/log"
 	"loki/subcommand"
 	"loki/utils"
+	"path/filepath"
 )
 
 // Init initializes a new Loki password-manager directory. This is usually ~/.loki.
-// or it is given as an argument.
+// or it is given as an argument. With --keyfile a random keyfile is created, the store
+// requires it in addition to the password. A keyfile given with -k is used as well. With --hidden
+// the names of the records are kept in an encrypted index instead of the filesystem.
 func Init(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
-	if len(args) > 0 && len(args[0]) > 0 {
-		cfg.SetSystemDirectory(args[0])
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	keyfile := flags.String("keyfile", "", "Create a random keyfile at the given path, required in addition to the password.")
+	hidden := flags.Bool("hidden", false, "Hide the names of the records in an encrypted index.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() > 1 {
+		return errors.New("Too many arguments given")
+	}
+
+	if flags.NArg() > 0 && len(flags.Arg(0)) > 0 {
+		cfg.SetSystemDirectory(flags.Arg(0))
 	}
 
+	if len(*keyfile) > 0 {
+		path, err := filepath.Abs(*keyfile)
+
+		if err != nil {
+			return err
+		}
+
+		if err := crypto.NewKeyfile(path); err != nil {
+			log.Error("Problem creating keyfile: %s, error: %v", path, err)
+			return err
+		}
+
+		log.Info("Created keyfile : %s, keep it safe, the store could not be unlocked without it.", path)
+		cfg.Keyfile = path
+	}
+
+	cfg.HiddenNames = *hidden
+
 	err := utils.InitBasedir(cfg)
 	basedir := cfg.SystemDirectory()
 
@@ -35,8 +35,45 @@ func TestCommandInit(t *testing.T) {
 		t.Fail()
 	}
 
+	masterfile, err := utils.LoadMasterfile(TBASE() + "loki" + SEP + ".master")
+
+	if err != nil || len(masterfile.Salt) == 0 || utils.KDFParametersFromMasterfile(masterfile).IsLegacy() {
+		t.Fail()
+	}
+
 	if err = os.RemoveAll(tmpDir); err != nil {
 		log.Error("%v", err)
 	}
 
 }
+
+func TestCommandInitWithKeyfile(t *testing.T) {
+	defer SetupTest(t)()
+
+	cfg.SetSystemDirectory(TBASE() + "loki")
+
+	if err := Init(cfg, cmd, "--keyfile", TBASE()+"loki.key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !utils.VerifyFile(TBASE() + "loki.key") {
+		t.Fail()
+	}
+
+	masterfile, err := utils.LoadMasterfile(TBASE() + "loki" + SEP + ".master")
+
+	if err != nil || !masterfile.KeyfileRequired {
+		t.Fail()
+	}
+
+	// the password alone is refused before prompting for it
+	if _, err := utils.LoadKeyDerivator(cfg); err == nil {
+		t.Error("keyfile not required")
+	}
+
+	cfg.Keyfile = TBASE() + "loki.key"
+
+	if _, err := utils.LoadKeyDerivator(cfg); err != nil {
+		t.Error(err)
+	}
+}
@@ -8,36 +8,77 @@ import (
 	"loki/subcommand"
 	"loki/utils"
 	"errors"
+	"flag"
+	"path/filepath"
 )
 
-// Insert adds a new record to the password store.
+// Insert adds a new record to the password store. The type of the record, login by default, is chosen with --type.
 func Insert(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	flags := flag.NewFlagSet("insert", flag.ContinueOnError)
+	typeName := flags.String("type", "login", "Type of the record: login, card, ssh, note or identity.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	args = flags.Args()
+
+	if len(args) < 1 {
+		return errors.New("Filename needed")
+	}
 
 	if len(args) > 1 {
 		return errors.New("Too many arguments given")
 	}
 
-	filename := utils.NormalizePath(args[0])
+	kind, err := storage.TypeFromName(*typeName)
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("Filename: " + filepath.Base(utils.NormalizePath(args[0])))
+
+	key, err := utils.GetMasterkey(cfg, true)
+
+	if err != nil {
+		return err
+	}
+
+	if err := utils.StoreKeyCheck(cfg.GetMasterfilename(), key); err != nil {
+		return err
+	}
 
-	file := utils.CreateLeadingDirectories(filename)
+	ix, err := openIndex(cfg, key)
 
-	log.Info("Filename: " + file)
+	if err != nil {
+		return err
+	}
 
-	key, _ := utils.GetMasterkey(true)
-	rec, err := storage.Ask()
+	rec, err := storage.Ask(kind)
 
 	if err != nil {
 		log.Info("Aborted.")
 		return nil
 	}
 
-	err = record.WriteRecord(filename, cfg.Generation, key, rec)
+	filename, err := newRecordFile(cfg, ix, args[0])
 
 	if err != nil {
 		return err
 	}
 
-	utils.SetupKeyAgent(key)
+	err = record.WriteNewRecord(filename, cfg.Generation, key, rec)
+
+	if err != nil {
+		return err
+	}
+
+	if err := saveIndex(ix, key); err != nil {
+		return err
+	}
+
+	utils.SetupKeyAgent(cfg, key)
 
 	return nil
 }
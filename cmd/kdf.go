@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"loki/config"
+	"loki/crypto"
+	"loki/log"
+	"loki/subcommand"
+	"loki/utils"
+	"time"
+)
+
+const defaultUnlockTime = 500 * time.Millisecond
+
+// Kdf handles the key derivation settings of the store. As of now the only subcommand is calibrate:
+// loki kdf calibrate [-apply] [-memory MiB] [target, e.g. 500ms]
+func Kdf(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	if args[0] != "calibrate" {
+		return fmt.Errorf("Unknown kdf subcommand: %s", args[0])
+	}
+
+	flags := flag.NewFlagSet("kdf calibrate", flag.ContinueOnError)
+	apply := flags.Bool("apply", false, "Re-encrypt the store using the suggested costs.")
+	memory := flags.Uint("memory", uint(crypto.Argon2DefaultMemory/1024), "Memory in MiB to start the calibration with.")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	target := defaultUnlockTime
+
+	if flags.NArg() > 1 {
+		return errors.New("Too many arguments given")
+	}
+
+	if flags.NArg() == 1 {
+		var err error
+
+		if target, err = time.ParseDuration(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Benchmarking Argon2id with %d threads for an unlock time of %v ...", crypto.Argon2DefaultThreads, target)
+
+	iterations, mem, elapsed := crypto.CalibrateArgon2(target, uint32(*memory)*1024, crypto.Argon2DefaultThreads)
+
+	log.Info("Suggested costs : time=%d, memory=%d MiB, threads=%d -> %v", iterations, mem/1024, crypto.Argon2DefaultThreads, elapsed.Round(time.Millisecond))
+
+	masterfile, err := utils.LoadMasterfile(cfg.GetMasterfilename())
+
+	if err != nil {
+		return err
+	}
+
+	current := utils.KDFParametersFromMasterfile(masterfile)
+
+	if current.IsLegacy() {
+		log.Info("Current costs   : legacy parameters without salt")
+	} else {
+		took := crypto.MeasureArgon2(current.Time, current.Memory, current.Threads)
+		log.Info("Current costs   : time=%d, memory=%d MiB, threads=%d -> %v", current.Time, current.Memory/1024, current.Threads, took.Round(time.Millisecond))
+	}
+
+	if !*apply {
+		log.Info("\nRun '%s kdf calibrate -apply %v' to re-encrypt the store with the suggested costs.", config.BinaryName, target)
+		return nil
+	}
+
+	if !current.IsLegacy() && current.Time == iterations && current.Memory == mem && current.Threads == crypto.Argon2DefaultThreads {
+		log.Info("Costs unchanged, nothing to do.")
+		return nil
+	}
+
+	return applyKDFParameters(cfg, current, iterations, mem, crypto.Argon2DefaultThreads)
+}
+
+// applyKDFParameters re-derives the key from the same password with the new costs and re-encrypts
+// the whole store with it, just like the change command does with a new password.
+func applyKDFParameters(cfg config.Configuration, current crypto.KDFParameters, iterations uint32, memory uint32, threads uint8) error {
+
+	if !utils.CheckBase(cfg) {
+		return fmt.Errorf("Problem getting basedir")
+	}
+
+	utils.ForgetAgentKey(cfg)
+
+	oldkdf, err := utils.StoreKeyDerivator(cfg, current)
+
+	if err != nil {
+		return err
+	}
+
+	params, err := crypto.NewKDFParametersWithCosts(iterations, memory, threads)
+
+	if err != nil {
+		return err
+	}
+
+	params.Keyfile = current.Keyfile
+	newkdf, err := utils.StoreKeyDerivator(cfg, params)
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("Please provide the password to re-encrypt the store.")
+	password, err := utils.PromptPassword(false)
+
+	if err != nil {
+		return err
+	}
+
+	oldkey := crypto.LocalKey(oldkdf(password))
+
+	if err := utils.VerifyMasterkey(cfg.GetMasterfilename(), oldkey); err != nil {
+		return err
+	}
+
+	fm, err := masterkeyFilemap(cfg.SystemDirectory(), oldkey)
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("Re-encrypting %d items.", len(*fm))
+
+	newkey := crypto.LocalKey(newkdf(password))
+
+	if err := rekeyStore(cfg, fm, oldkey, newkey, params); err != nil {
+		return err
+	}
+
+	// the masterfile got the next generation and possibly the first store ID
+	if masterfile, err := utils.LoadMasterfile(cfg.GetMasterfilename()); err == nil {
+		cfg.Generation = masterfile.Generation
+		cfg.StoreID = masterfile.StoreId
+	}
+
+	utils.SetupKeyAgent(cfg, newkey)
+	return nil
+}
@@ -2,40 +2,129 @@ package cmd
 
 import (
 	"errors"
+	"flag"
+	"fmt"
 	"github.com/xlab/treeprint"
 	"loki/config"
+	"loki/crypto"
+	"loki/index"
 	"loki/log"
+	"loki/record"
+	"loki/storage"
 	"loki/subcommand"
 	tu "loki/tree"
 	"loki/utils"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type treeMap map[string]treeprint.Tree
 
-// List displays the contents of the password store in a treelike fashion.
+// List displays the contents of the password store in a treelike fashion. With --long the modification and
+// expiry dates of the records are shown as well, --type shows only the records of the given type. Both need the
+// masterpassword.
 func List(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := flags.Bool("long", false, "Show modification and expiry dates.")
+	typeName := flags.String("type", "", "Show only records of the type: login, card, ssh, note or identity.")
 
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	args = flags.Args()
 	base := cfg.SystemDirectory()
 
 	if !utils.CheckBase(cfg) {
 		return errors.New("could not find basedir")
 	}
 
-	// possibly adding a subdir
+	describe := func(string) string { return "" }
+	keep := func(string) bool { return true }
+
+	var key crypto.Key
+
+	if *long || len(*typeName) > 0 || cfg.HiddenNames {
+		var err error
+
+		if key, err = utils.GetMasterkey(cfg, false); err != nil {
+			return err
+		}
+	}
+
+	if *long {
+		describe = recordDates(key)
+	}
+
+	if len(*typeName) > 0 {
+		kind, err := storage.TypeFromName(*typeName)
+
+		if err != nil {
+			return err
+		}
+
+		keep = recordOfType(key, kind)
+	}
+
+	if cfg.HiddenNames {
+		if err := listHidden(cfg, key, append(args, "")[0], describe, keep); err != nil {
+			return err
+		}
+	} else {
+		// possibly adding a subdir
+
+		if len(args) > 0 && utils.VerifyDirectory(base+string(os.PathSeparator)+args[0]) {
+			base += string(filepath.Separator) + args[0]
+		}
 
-	if len(args) > 0 && utils.VerifyDirectory(base+string(os.PathSeparator)+args[0]) {
-		base += string(filepath.Separator) + args[0]
+		walker(base, describe, keep)
 	}
 
-	walker(base)
+	if key != nil {
+		utils.SetupKeyAgent(cfg, key)
+	}
 
 	return nil
 }
 
-func walker(dir string) {
+// recordOfType returns a function telling whether the record stored in a file is of the given type. Records which
+// could not be read are kept, so they still show up.
+func recordOfType(key crypto.Key, kind storage.RecordType) func(filename string) bool {
+	return func(filename string) bool {
+		rec, _, err := record.LoadRecord(filename, key)
+		return err != nil || rec.Type == kind
+	}
+}
+
+// recordDates returns a function describing the record stored in a file by its modification and expiry dates.
+func recordDates(key crypto.Key) func(filename string) string {
+	return func(filename string) string {
+		rec, _, err := record.LoadRecord(filename, key)
+
+		if err != nil {
+			return fmt.Sprintf("  (%v)", err)
+		}
+
+		description := "  " + time.Unix(rec.Modified, 0).Format(config.TimeFormat)
+
+		if rec.Modified == 0 {
+			description = "  " + strings.Repeat("-", len(config.TimeFormat))
+		}
+
+		if rec.Expires > 0 {
+			description += ", expires " + storage.FormatDate(rec.Expires)
+		}
+
+		return description
+	}
+}
+
+// walker displays the tree below dir, the names of the records kept by keep followed by what describe returns for
+// their files.
+func walker(dir string, describe func(filename string) string, keep func(filename string) bool) {
 
 	tm := make(treeMap)
 	tree := treeprint.New()
@@ -55,8 +144,8 @@ func walker(dir string) {
 
 		if info.IsDir() {
 			tm[relPath] = parent.AddBranch(info.Name())
-		} else {
-			parent.AddNode(strings.TrimSuffix(info.Name(), config.FileSuffix))
+		} else if keep(path) {
+			parent.AddNode(strings.TrimSuffix(info.Name(), config.FileSuffix) + describe(path))
 		}
 
 		return nil
@@ -71,6 +160,61 @@ func walker(dir string) {
 	}
 }
 
+// listHidden displays the records of a store with hidden names below dir, built from the names in the index.
+func listHidden(cfg config.Configuration, key crypto.Key, dir string, describe func(filename string) string, keep func(filename string) bool) error {
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
+		return err
+	}
+
+	tm := make(treeMap)
+	tree := treeprint.New()
+	prefix := index.Clean(dir)
+
+	if !ix.IsDir(prefix) {
+		prefix = ""
+	}
+
+	for _, name := range ix.Below(prefix) {
+		filename, _ := recordFile(cfg, ix, name)
+
+		if !keep(filename) {
+			continue
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(name, prefix), "/")
+		parent := tree
+		dir := ""
+
+		for _, part := range strings.Split(path.Dir(relPath), "/") {
+			if part == "." {
+				break
+			}
+
+			dir = path.Join(dir, part)
+
+			if _, ok := tm[dir]; !ok {
+				tm[dir] = parent.AddBranch(part)
+			}
+
+			parent = tm[dir]
+		}
+
+		parent.AddNode(path.Base(relPath) + describe(filename))
+	}
+
+	output := tree.String()
+
+	if output == ".\n" {
+		log.Info("no data.")
+	} else {
+		log.Info(output)
+	}
+
+	return nil
+}
+
 func lookupParent(tm treeMap, path string) treeprint.Tree {
 	if len(path) == 0 {
 		return nil
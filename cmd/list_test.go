@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"loki/record"
+	"loki/storage"
+	"testing"
+)
+
+func TestListType(t *testing.T) {
+	defer SetupTest(t)()
+
+	card := storage.Record{Title: "card", Type: storage.RecordType_CARD, Card: &storage.Card{Number: "4111111111111111"}}
+
+	if err := record.WriteRecord(TBASE()+"card.loki", cfg.Generation, testKey(), &card); err != nil {
+		t.Fatal(err)
+	}
+
+	if !recordOfType(testKey(), storage.RecordType_CARD)(TBASE() + "card.loki") {
+		t.Error("card not kept")
+	}
+
+	if recordOfType(testKey(), storage.RecordType_LOGIN)(TBASE() + "card.loki") {
+		t.Error("card kept as login")
+	}
+
+	if err := List(cfg, cmd, "--type", "card"); err != nil {
+		t.Error(err)
+	}
+
+	if err := List(cfg, cmd, "--type", "bike"); err == nil {
+		t.Error("unknown type accepted")
+	}
+}
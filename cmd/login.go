@@ -2,27 +2,48 @@ package cmd
 
 import (
 	"loki/config"
-	"loki/crypto"
 	"loki/log"
 	"loki/subcommand"
-	"loki/tree"
 	"loki/utils"
 )
 
-var kdf = crypto.NewKeyDerivator()
-
-// Login lets you verify password against the loki-store and thereby starting an key-agent for your convienience.
+// Login lets you verify password against the key check of the loki-store and thereby starting an key-agent for your convienience.
+// The times the agent is going to forget the key are shown.
 func Login(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
-	key, _ := utils.GetMasterkey(false)
-	base := cfg.SystemDirectory()
+	key, err := utils.GetMasterkey(cfg, false)
 
-	rec := tree.GetFirstRecord(base, key)
+	if err != nil {
+		return err
+	}
 
-	if rec == nil {
-		log.Info("No data found, therefore no login.")
+	if key == nil {
+		log.Info("Unlocked with your identity, no agent started.")
 		return nil
 	}
 
-	utils.SetupKeyAgent(key)
+	utils.SetupKeyAgent(cfg, key)
+	showSession()
 	return nil
 }
+
+// showSession tells when the agent just set up is going to forget the key.
+func showSession() {
+	status, err := utils.AgentStatus()
+
+	if err != nil {
+		log.Debug("No status from agent: %v", err)
+		return
+	}
+
+	if status.IdleDeadline.IsZero() && status.EndOfLife.IsZero() {
+		log.Info("Session does not expire, end it with: loki stop")
+	}
+
+	if !status.IdleDeadline.IsZero() {
+		log.Info("Session expires at %s unless used again.", status.IdleDeadline.Format(config.TimeFormat))
+	}
+
+	if !status.EndOfLife.IsZero() {
+		log.Info("Session ends at %s at the latest.", status.EndOfLife.Format(config.TimeFormat))
+	}
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"loki/config"
+	"loki/crypto"
+	"loki/utils"
+	"testing"
+	"time"
+)
+
+func TestLoginEmptyStore(t *testing.T) {
+	defer SetupTest(t)()
+
+	cfg.SetSystemDirectory(TBASE() + "empty")
+
+	initStore(t)
+
+	// init confirms the password and pins it
+	if !utils.HasKeyCheck(cfg.GetMasterfilename()) {
+		t.Fatal("no key check stored")
+	}
+
+	if err := Login(cfg, cmd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoKeyCheckFromReadingCommands(t *testing.T) {
+	defer SetupTest(t)()
+
+	if err := Show(cfg, cmd, "file1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if utils.HasKeyCheck(cfg.GetMasterfilename()) {
+		t.Error("key check stored by show")
+	}
+
+	if err := Upgrade(cfg, cmd, "--dry-run"); err != nil {
+		t.Fatal(err)
+	}
+
+	if utils.HasKeyCheck(cfg.GetMasterfilename()) {
+		t.Error("key check stored by a dry run")
+	}
+
+	if err := Upgrade(cfg, cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	if !utils.HasKeyCheck(cfg.GetMasterfilename()) {
+		t.Error("no key check stored by upgrade")
+	}
+}
+
+func TestWrongMasterkey(t *testing.T) {
+	defer SetupTest(t)()
+
+	other, _ := crypto.NewRandomKey()
+
+	if err := utils.StoreKeyCheck(cfg.GetMasterfilename(), crypto.LocalKey(other)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the agent holds the key of the testdata, which does not match the key check any more
+	if err := Show(cfg, cmd, "file1"); err == nil {
+		t.Error("record shown with wrong masterkey")
+	}
+}
+
+func TestAgentStatus(t *testing.T) {
+	status, err := utils.AgentStatus()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Locked || status.IdleDeadline.After(time.Now().Add(config.DefaultIdleTimeout)) || status.EndOfLife.Before(status.IdleDeadline) {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
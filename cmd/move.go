@@ -2,11 +2,14 @@ package cmd
 
 import (
 	"loki/config"
+	"loki/crypto"
+	"loki/index"
 	"loki/log"
 	"loki/subcommand"
 	"loki/utils"
 	"fmt"
 	"os"
+	"path"
 	"strings"
 )
 
@@ -17,10 +20,14 @@ import (
 // dir1 -> dir2
 // dir1 -> file1 ***** ERROR *****
 func Move(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
-	key, _ := utils.GetMasterkey(false)
+	key, err := utils.GetMasterkey(cfg, false)
 
-	if key == nil {
-		return fmt.Errorf("could not get Masterkey")
+	if err != nil {
+		return err
+	}
+
+	if cfg.HiddenNames {
+		return moveHidden(cfg, key, args[0], args[1])
 	}
 
 	srcIsDir := false
@@ -72,6 +79,55 @@ func Move(cfg config.Configuration, subcommand subcommand.Subcommand, args ...st
 		return err
 	}
 
-	utils.SetupKeyAgent(key)
+	if err := rewrapRecords(dst, key); err != nil {
+		return err
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// moveHidden renames records in the index of a store with hidden names, the files themselves stay where they are.
+// The same rules as for plain names apply.
+func moveHidden(cfg config.Configuration, key crypto.Key, src string, dst string) error {
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ix.Lookup(src); ok {
+		if ix.IsDir(dst) {
+			dst = path.Join(index.Clean(dst), path.Base(index.Clean(src)))
+		}
+
+		log.Info("Moving: %s -> %s", index.Clean(src), index.Clean(dst))
+
+		if err := ix.Rename(src, dst); err != nil {
+			return err
+		}
+	} else if names := ix.Below(src); len(names) > 0 {
+		if _, ok := ix.Lookup(dst); ok || strings.HasSuffix(dst, config.FileSuffix) {
+			return fmt.Errorf("Destination should be no filename when moving directories: %s -> %s", src, dst)
+		}
+
+		log.Info("Moving: %s -> %s", index.Clean(src), index.Clean(dst))
+
+		for _, name := range names {
+			rel := strings.TrimPrefix(name, index.Clean(src)+"/")
+
+			if err := ix.Rename(name, path.Join(index.Clean(dst), rel)); err != nil {
+				return err
+			}
+		}
+	} else {
+		return fmt.Errorf("Could not find source: %s", src)
+	}
+
+	if err := ix.Save(key); err != nil {
+		return err
+	}
+
+	utils.SetupKeyAgent(cfg, key)
 	return nil
 }
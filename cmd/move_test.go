@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"loki/crypto"
 	"loki/log"
+	"loki/record"
 	"loki/utils"
 	"testing"
 )
@@ -49,3 +51,24 @@ func TestMoveCase4_dir_dir(t *testing.T) {
 	}
 	log.Debug("All is fine.")
 }
+
+func TestMoveRecipients(t *testing.T) {
+	defer SetupTest(t)()
+	defer record.SetIdentityLoader(nil)
+
+	alice, _ := crypto.NewIdentity()
+
+	if err := Recipients(cfg, cmd, "add", "dir3", crypto.EncodePublicKey(alice.PublicKey), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	record.SetIdentityLoader(func() (*crypto.Identity, error) { return alice, nil })
+
+	if err := Move(cfg, cmd, "file2", "dir3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := record.LoadRecord(TBASE()+"dir3"+SEP+"file2.loki", nil); err != nil {
+		t.Errorf("recipient has no access to the moved record: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"loki/config"
+	"loki/crypto"
+	"loki/index"
+	"loki/subcommand"
+	"loki/tree"
+	"loki/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// openIndex returns the index of a store with hidden names or nil for a store with plain names. A new store
+// starts with an empty index.
+func openIndex(cfg config.Configuration, key crypto.Key) (*index.Index, error) {
+	if !cfg.HiddenNames {
+		return nil, nil
+	}
+
+	if key == nil {
+		return nil, errors.New("stores with hidden names need the masterpassword")
+	}
+
+	filename := filepath.Join(cfg.SystemDirectory(), config.IndexFilename)
+
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return index.New(filename), nil
+	}
+
+	return index.Load(filename, key)
+}
+
+// saveIndex stores the index, if there is one.
+func saveIndex(ix *index.Index, key crypto.Key) error {
+	if ix == nil {
+		return nil
+	}
+
+	return ix.Save(key)
+}
+
+// recordFile returns the file the existing record with the given name is stored in. With hidden names
+// the name is looked up in the index.
+func recordFile(cfg config.Configuration, ix *index.Index, name string) (string, error) {
+	if ix == nil {
+		filename := utils.NormalizePath(name)
+
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return "", fmt.Errorf("Record does not exist: %s", name)
+		}
+
+		return filename, nil
+	}
+
+	file, ok := ix.Lookup(name)
+
+	if !ok {
+		return "", fmt.Errorf("Record does not exist: %s", name)
+	}
+
+	return filepath.Join(cfg.SystemDirectory(), file), nil
+}
+
+// newRecordFile returns the file to store a new record with the given name in. Plain names get their leading
+// directories created, hidden names get a new entry in the index.
+func newRecordFile(cfg config.Configuration, ix *index.Index, name string) (string, error) {
+	if ix == nil {
+		filename := utils.NormalizePath(name)
+		utils.CreateLeadingDirectories(filename)
+		return filename, nil
+	}
+
+	file, err := ix.Add(name)
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cfg.SystemDirectory(), file), nil
+}
+
+// walkRecords calls fn for every record of the store with its name and the file it is stored in, sorted by name.
+func walkRecords(cfg config.Configuration, ix *index.Index, fn func(name string, filename string) error) error {
+	if ix != nil {
+		for _, name := range ix.Below("") {
+			filename, _ := recordFile(cfg, ix, name)
+
+			if err := fn(name, filename); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	base := cfg.SystemDirectory()
+	var outError error
+
+	tree.FilteredWalk(base, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() || outError != nil {
+			return nil
+		}
+
+		outError = fn(strings.TrimSuffix(strings.TrimPrefix(path, base+string(os.PathSeparator)), config.FileSuffix), path)
+		return nil
+	})
+
+	return outError
+}
+
+// Names prints the names of all records and directories, one per line. This is used by the bash completion,
+// for stores with hidden names in particular. The key is only taken from the agent, the user is never prompted.
+func Names(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	var names []string
+
+	if cfg.HiddenNames {
+		key, err := utils.GetMasterkeyFromAgent(cfg)
+
+		if err != nil {
+			return err
+		}
+
+		ix, err := openIndex(cfg, key)
+
+		if err != nil {
+			return err
+		}
+
+		names = ix.Below("")
+	} else {
+		walkRecords(cfg, nil, func(name string, filename string) error {
+			names = append(names, name)
+			return nil
+		})
+	}
+
+	dirs := make(map[string]bool)
+
+	for _, name := range names {
+		for dir := filepath.Dir(name); dir != "." && !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+			fmt.Println(dir + "/")
+		}
+		fmt.Println(name)
+	}
+
+	return nil
+}
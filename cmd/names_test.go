@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"loki/record"
+	"loki/storage"
+	"strings"
+	"testing"
+)
+
+func TestHiddenNames(t *testing.T) {
+	defer SetupTest(t)()
+
+	cfg.SetSystemDirectory(TBASE() + "hidden")
+
+	key := initStore(t, "--hidden")
+	cfg.HiddenNames = true
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename, err := newRecordFile(cfg, ix, "mail/work")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := record.WriteRecord(filename, cfg.Generation, key, &storage.Record{Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := saveIndex(ix, key); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := ioutil.ReadDir(cfg.SystemDirectory())
+
+	for _, f := range files {
+		if f.IsDir() || strings.Contains(f.Name(), "work") {
+			t.Errorf("name visible on disk: %s", f.Name())
+		}
+	}
+
+	if err := Show(cfg, cmd, "mail/work"); err != nil {
+		t.Error(err)
+	}
+
+	if err := Move(cfg, cmd, "mail", "job"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Copy(cfg, cmd, "job/work", "web"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Show(cfg, cmd, "mail/work"); err == nil {
+		t.Error("moved record still found")
+	}
+
+	if err := Remove(cfg, cmd, "job"); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, _ = openIndex(cfg, key)
+
+	if names := ix.Below(""); len(names) != 1 || names[0] != "web" {
+		t.Errorf("unexpected names: %v", names)
+	}
+
+	if err := Recipients(cfg, cmd, "list"); err == nil {
+		t.Error("recipients used with hidden names")
+	}
+}
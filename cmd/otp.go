@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"loki/config"
+	"loki/crypto"
+	"loki/log"
+	"loki/record"
+	"loki/subcommand"
+	"loki/utils"
+	"os"
+	"time"
+
+	"github.com/atotto/clipboard"
+)
+
+// Otp prints the current one-time password of a record together with the seconds it is still valid. The code is
+// copied to the clipboard with -c. HOTP records get their counter raised. With --import the otpauth:// URI given
+// or read from stdin, e.g. the text decoded from a QR code, is stored in the record.
+func Otp(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	flags := flag.NewFlagSet("otp", flag.ContinueOnError)
+	importURI := flags.Bool("import", false, "Store the otpauth URI given or read from stdin in the record.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 {
+		return errors.New("Record needed")
+	}
+
+	if flags.NArg() > 2 || (flags.NArg() > 1 && !*importURI) {
+		return errors.New("Too many arguments given")
+	}
+
+	key, rec, filename, err := loadNamedRecord(cfg, flags.Arg(0))
+
+	if err != nil {
+		return err
+	}
+
+	if *importURI {
+		uri := flags.Arg(1)
+
+		if len(uri) == 0 {
+			data, err := ioutil.ReadAll(os.Stdin)
+
+			if err != nil {
+				return err
+			}
+
+			uri = string(data)
+		}
+
+		otp, err := crypto.ParseOTP(uri)
+
+		if err != nil {
+			return err
+		}
+
+		rec.Otpauth = otp.URI()
+
+		if err := record.WriteRecord(filename, cfg.Generation, key, rec); err != nil {
+			return err
+		}
+
+		log.Info("Imported %s (%s)", otp.Label, otp.Type)
+		utils.SetupKeyAgent(cfg, key)
+		return nil
+	}
+
+	if len(rec.Otpauth) == 0 {
+		return errors.New("No otpauth URI in record: " + flags.Arg(0))
+	}
+
+	otp, err := crypto.ParseOTP(rec.Otpauth)
+
+	if err != nil {
+		return err
+	}
+
+	code, left := otp.Code(time.Now())
+
+	// the counter has to be stored before the code is shown, a code must never be handed out twice
+	if otp.Type == "hotp" {
+		rec.Otpauth = otp.URI()
+
+		if err := record.WriteRecord(filename, cfg.Generation, key, rec); err != nil {
+			return err
+		}
+
+		log.Info("%s", code)
+	} else {
+		log.Info("%s (%ds left)", code, left)
+	}
+
+	if cfg.Clipboard {
+		clipboard.WriteAll(code)
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"loki/record"
+	"loki/storage"
+	"strings"
+	"testing"
+)
+
+func TestOtp(t *testing.T) {
+	defer SetupTest(t)()
+
+	filename := TBASE() + "otp.loki"
+
+	if err := record.WriteRecord(filename, cfg.Generation, testKey(), &storage.Record{Title: "otp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Otp(cfg, cmd, "otp"); err == nil {
+		t.Error("record without otpauth URI accepted")
+	}
+
+	// secret "12345678901234567890" of RFC 4226
+	uri := "QR-Code:otpauth://hotp/Example:alice?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&counter=0"
+
+	if err := Otp(cfg, cmd, "--import", "otp", uri); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Otp(cfg, cmd, "otp"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, _, err := record.LoadRecord(filename, testKey())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(rec.Otpauth, "otpauth://hotp/") || !strings.Contains(rec.Otpauth, "counter=1") {
+		t.Errorf("counter not raised: %s", rec.Otpauth)
+	}
+
+	if err := Otp(cfg, cmd, "--import", "otp", "https://example.com"); err == nil {
+		t.Error("invalid URI imported")
+	}
+}
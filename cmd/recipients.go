@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"loki/config"
+	"loki/crypto"
+	"loki/log"
+	"loki/record"
+	"loki/subcommand"
+	"loki/tree"
+	"loki/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Recipients manages the team members the records of a subtree are encrypted for:
+// loki recipients identity
+// loki recipients list [dir]
+// loki recipients add <dir> <public key> [name]
+// loki recipients remove <dir> <public key|name>
+func Recipients(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+	if cfg.HiddenNames {
+		return errors.New("Recipients are not supported in stores with hidden names")
+	}
+
+	switch args[0] {
+	case "identity":
+		return showIdentity(cfg, args[1:]...)
+	case "list", "ls":
+		return listRecipients(cfg, args[1:]...)
+	case "add":
+		return addRecipient(cfg, args[1:]...)
+	case "remove", "rm":
+		return removeRecipient(cfg, args[1:]...)
+	}
+
+	return fmt.Errorf("Unknown recipients subcommand: %s", args[0])
+}
+
+// showIdentity prints the public key of the users identity and creates the identity if there is none yet.
+func showIdentity(cfg config.Configuration, args ...string) error {
+	if len(args) > 0 {
+		return errors.New("Too many arguments given")
+	}
+
+	path := cfg.GetIdentityFilename()
+	identityfile, err := utils.LoadIdentityFile(path)
+
+	if err == nil {
+		log.Info("%s %s", crypto.EncodePublicKey(identityfile.PublicKey), path)
+		return nil
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return err
+	}
+
+	log.Info("Creating a new identity %s.", path)
+	log.Info("Please provide the password to protect your private key with.")
+
+	password, err := utils.PromptPassword(true)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := utils.WriteNewIdentity(path, password)
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("%s %s", crypto.EncodePublicKey(id.PublicKey), path)
+	return nil
+}
+
+func listRecipients(cfg config.Configuration, args ...string) error {
+	if len(args) > 1 {
+		return errors.New("Too many arguments given")
+	}
+
+	dir, err := recipientsDirectory(cfg, append(args, ".")[0])
+
+	if err != nil {
+		return err
+	}
+
+	recipients, err := record.FindRecipients(dir)
+
+	if err != nil {
+		return err
+	}
+
+	if len(recipients) == 0 {
+		log.Info("No recipients, protected by the masterpassword only.")
+		return nil
+	}
+
+	for _, r := range recipients {
+		log.Info("%s %s", crypto.EncodePublicKey(r.PublicKey), r.Name)
+	}
+
+	return nil
+}
+
+func addRecipient(cfg config.Configuration, args ...string) error {
+	if len(args) < 2 {
+		return errors.New("Directory and public key needed")
+	}
+
+	dir, err := recipientsDirectory(cfg, args[0])
+
+	if err != nil {
+		return err
+	}
+
+	key, err := crypto.DecodePublicKey(args[1])
+
+	if err != nil {
+		return err
+	}
+
+	// a new .recipients file takes over the recipients inherited so far
+	recipients, err := record.FindRecipients(dir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, r := range recipients {
+		if bytes.Equal(r.PublicKey, key) {
+			return errors.New("Recipient already present: " + args[1])
+		}
+	}
+
+	recipients = append(recipients, record.Recipient{PublicKey: key, Name: strings.Join(args[2:], " ")})
+
+	if err := record.StoreRecipients(dir, recipients); err != nil {
+		return err
+	}
+
+	return rewrapSubtree(cfg, dir)
+}
+
+func removeRecipient(cfg config.Configuration, args ...string) error {
+	if len(args) != 2 {
+		return errors.New("Directory and public key or name needed")
+	}
+
+	dir, err := recipientsDirectory(cfg, args[0])
+
+	if err != nil {
+		return err
+	}
+
+	recipients, err := record.LoadRecipients(dir)
+
+	if err != nil {
+		return err
+	}
+
+	kept := []record.Recipient{}
+
+	for _, r := range recipients {
+		if crypto.EncodePublicKey(r.PublicKey) != args[1] && r.Name != args[1] {
+			kept = append(kept, r)
+		}
+	}
+
+	if len(kept) == len(recipients) {
+		return fmt.Errorf("Recipient not found in %s: %s", filepath.Join(dir, config.RecipientsFile), args[1])
+	}
+
+	if err := record.StoreRecipients(dir, kept); err != nil {
+		return err
+	}
+
+	return rewrapSubtree(cfg, dir)
+}
+
+// recipientsDirectory returns the absolute path of the directory given with name, which must be part of the store.
+func recipientsDirectory(cfg config.Configuration, name string) (string, error) {
+	base, err := filepath.Abs(cfg.SystemDirectory())
+
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := filepath.Abs(name)
+
+	if err != nil {
+		return "", err
+	}
+
+	if dir != base && !strings.HasPrefix(dir, base+string(os.PathSeparator)) {
+		return "", errors.New("Directory not part of the store: " + name)
+	}
+
+	if !utils.VerifyDirectory(dir) {
+		return "", errors.New("Directory not found: " + name)
+	}
+
+	return dir, nil
+}
+
+// rewrapSubtree wraps the data keys of all records below dir for the recipients currently responsible. The
+// generation and the encrypted payloads stay the same.
+func rewrapSubtree(cfg config.Configuration, dir string) error {
+	key, err := utils.GetMasterkey(cfg, false)
+
+	if err != nil {
+		return err
+	}
+
+	rewrapped, failed := 0, 0
+
+	tree.FilteredWalk(dir, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(path, dir+string(os.PathSeparator))
+		hdr, err := record.LoadHeader(path)
+
+		if err == nil {
+			err = record.ChangeKey(path, hdr.Generation, key, key)
+		}
+
+		if err != nil {
+			log.Error("Failed   : %s: %v", relPath, err)
+			failed++
+			return nil
+		}
+
+		log.Debug("Rewrapped: %s", relPath)
+		rewrapped++
+		return nil
+	})
+
+	log.Info("Rewrapped: %d, failed: %d", rewrapped, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d records could not be rewrapped", failed)
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"loki/crypto"
+	"loki/record"
+	"testing"
+)
+
+func TestRecipientsAddRemove(t *testing.T) {
+	defer SetupTest(t)()
+	defer record.SetIdentityLoader(nil)
+
+	alice, _ := crypto.NewIdentity()
+	filename := TBASE() + "dir3" + SEP + "sub" + SEP + "bingo.loki"
+
+	if err := Recipients(cfg, cmd, "add", "dir3", crypto.EncodePublicKey(alice.PublicKey), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	record.SetIdentityLoader(func() (*crypto.Identity, error) { return alice, nil })
+
+	if _, _, err := record.LoadRecord(filename, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Recipients(cfg, cmd, "add", "dir3", crypto.EncodePublicKey(alice.PublicKey)); err == nil {
+		t.Error("recipient added twice")
+	}
+
+	if err := Recipients(cfg, cmd, "remove", "dir3", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := record.LoadRecord(filename, nil); err == nil {
+		t.Error("removed recipient still has access")
+	}
+
+	if _, _, err := record.LoadRecord(filename, testKey()); err != nil {
+		t.Error(err)
+	}
+}
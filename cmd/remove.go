@@ -1,32 +1,37 @@
 package cmd
 
 import (
+	"errors"
 	"loki/config"
 	"loki/log"
 	"loki/subcommand"
 	"loki/utils"
-	"errors"
 	"os"
+	"path/filepath"
 )
 
 // Remove removes either a single password file or a subtree from the store.
 func Remove(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
 	filename := args[0]
 
+	if cfg.HiddenNames {
+		return removeHidden(cfg, filename)
+	}
+
 	if isDir(filename) {
-		key, _ := utils.GetMasterkey(false)
+		key, err := utils.GetMasterkey(cfg, false)
 
-		if key == nil {
-			return errors.New("could not get Masterkey")
+		if err != nil {
+			return err
 		}
 
-		err := os.RemoveAll(filename)
+		err = os.RemoveAll(filename)
 
 		if err != nil {
 			log.Error("Error removing directory: %v", err)
 			return err
 		}
-		utils.SetupKeyAgent(key)
+		utils.SetupKeyAgent(cfg, key)
 		return nil
 	}
 
@@ -39,10 +44,10 @@ func Remove(cfg config.Configuration, subcommand subcommand.Subcommand, args ...
 		return err
 	}
 
-	key, _ := utils.GetMasterkey(false)
+	key, err := utils.GetMasterkey(cfg, false)
 
-	if key == nil {
-		return errors.New("could not get Masterkey")
+	if err != nil {
+		return err
 	}
 
 	err = os.Remove(filename)
@@ -52,7 +57,47 @@ func Remove(cfg config.Configuration, subcommand subcommand.Subcommand, args ...
 
 	}
 
-	utils.SetupKeyAgent(key)
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// removeHidden removes a record or a whole directory of a store with hidden names, together with their index entries.
+func removeHidden(cfg config.Configuration, name string) error {
+	key, err := utils.GetMasterkey(cfg, false)
+
+	if err != nil {
+		return err
+	}
+
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
+		return err
+	}
+
+	names := ix.Below(name)
+
+	if _, ok := ix.Lookup(name); ok {
+		names = []string{name}
+	}
+
+	if len(names) == 0 {
+		return errors.New("Path does not exist : " + name)
+	}
+
+	for _, n := range names {
+		file, _ := ix.Remove(n)
+
+		if err := os.Remove(filepath.Join(cfg.SystemDirectory(), file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := ix.Save(key); err != nil {
+		return err
+	}
+
+	utils.SetupKeyAgent(cfg, key)
 	return nil
 }
 
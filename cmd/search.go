@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"loki/config"
+	"loki/crypto"
+	"loki/index"
 	"loki/log"
 	"loki/record"
 	"loki/subcommand"
@@ -24,21 +26,58 @@ func Search(cfg config.Configuration, subcommand subcommand.Subcommand, args ...
 		return errors.New("could not find basedir")
 	}
 
-	var key []byte
+	var key crypto.Key
 	var err error
 
-	if key, err = utils.GetMasterkey(false); err != nil {
+	if key, err = utils.GetMasterkey(cfg, false); err != nil {
 		return fmt.Errorf("Problem getting masterkey: %v", err)
 	}
 
+	if cfg.HiddenNames {
+		ix, err := openIndex(cfg, key)
+
+		if err != nil {
+			return err
+		}
+
+		if searchIndex(cfg, ix, key, searchstring) == nil {
+			utils.SetupKeyAgent(cfg, key)
+		}
+
+		return nil
+	}
+
 	if searchWalker(base, key, searchstring, cfg.Blindmode) == nil {
-		utils.SetupKeyAgent(key)
+		utils.SetupKeyAgent(cfg, key)
+	}
+
+	return nil
+}
+
+// searchIndex searches the records of a store with hidden names, matching the names kept in the index.
+func searchIndex(cfg config.Configuration, ix *index.Index, key crypto.Key, searchstring string) error {
+	for _, name := range ix.Below("") {
+		filename, _ := recordFile(cfg, ix, name)
+		relPath := name + config.FileSuffix
+
+		rec, _, err := record.LoadRecord(filename, key)
+
+		if err != nil {
+			log.Error("Error reading record. Name: %s, Error: %v", name, err)
+			return err
+		}
+
+		if rec.Search(searchstring) || strings.Contains(strings.ToLower(relPath), searchstring) {
+			log.Info("Record: %s\n", utils.Highlight(relPath, searchstring))
+			utils.PrefixedDisplayWithHighlighting(rec, 0, searchstring, cfg.Blindmode)
+			log.Info("")
+		}
 	}
 
 	return nil
 }
 
-func searchWalker(dir string, key []byte, searchstring string, blind bool) error {
+func searchWalker(dir string, key crypto.Key, searchstring string, blind bool) error {
 
 	var outError error
 
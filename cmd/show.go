@@ -7,19 +7,28 @@ import (
 	"loki/subcommand"
 	"loki/utils"
 	"github.com/atotto/clipboard"
-	"os"
 )
 
 // Show displays a single record (lokifile) with all its content.
 func Show(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
-	filename := utils.NormalizePath(args[0])
+	key, err := utils.GetMasterkey(cfg, false)
 
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		log.Error("File does not exist: %v", err)
+	if err != nil {
+		return err
+	}
+
+	ix, err := openIndex(cfg, key)
+
+	if err != nil {
 		return err
 	}
 
-	key, _ := utils.GetMasterkey(false)
+	filename, err := recordFile(cfg, ix, args[0])
+
+	if err != nil {
+		log.Error("%v", err)
+		return err
+	}
 
 	rec, hdr, err := record.LoadRecord(filename, key)
 
@@ -28,16 +37,16 @@ func Show(cfg config.Configuration, subcommand subcommand.Subcommand, args ...st
 		return err
 	}
 
-	log.Info("Record: %s\n", filename)
+	log.Info("Record: %s\n", utils.NormalizePath(args[0]))
 	hdr.Print(0)
 
 	utils.Display(rec, cfg.Blindmode)
 
 	if cfg.Clipboard {
-		clipboard.WriteAll(rec.Password)
+		clipboard.WriteAll(rec.Secret())
 	}
 
-	utils.SetupKeyAgent(key)
+	utils.SetupKeyAgent(cfg, key)
 
 	return nil
 }
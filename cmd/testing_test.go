@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"loki/config"
+	"loki/crypto"
 	"loki/log"
 	"loki/subcommand"
 	"loki/utils"
@@ -46,20 +47,17 @@ func TestMain(m *testing.M) {
 
 	flagBundle = config.ParseFlags()
 
-	// IMPORTANT: This is the key for the empty "" password just hittig return:
-	key, err := hex.DecodeString("f54d6aba8329dea96d4b3daa8caaa05e06bd10c246a40d510d2feb3e73b620bb")
+	key := testKey()
 
-	if err != nil {
-		log.Error("Error decoding key")
-		return
-	}
+	// prompts are answered with the empty password of the testdata
+	utils.SetPasswordReader(func() ([]byte, error) { return []byte{}, nil })
 
 	cwd, _ := os.Getwd()
 	log.Debug("PWD: %s", cwd)
 
 	startDir = cwd
 
-	if err = utils.SetupKeyAgentWithBinpath(key, "../bin"); err != nil {
+	if err := utils.SetupKeyAgentWithBinpath(cfg, key, "../bin"); err != nil {
 		log.Error("Problem setting-up keyagent for tests: %v", err)
 		return
 	}
@@ -74,6 +72,35 @@ func TestMain(m *testing.M) {
 
 }
 
+// initStore initializes a store like main does and returns its key, init is answered with the empty password.
+func initStore(t *testing.T, args ...string) crypto.LocalKey {
+	if err := Init(cfg, cmd, args...); err != nil {
+		t.Fatal(err)
+	}
+
+	masterfile, err := utils.LoadMasterfile(cfg.GetMasterfilename())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.StoreID = masterfile.StoreId
+	kdf, err := utils.LoadKeyDerivator(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kdf([]byte{})
+}
+
+// testKey returns the key the testdata is encrypted with.
+func testKey() crypto.LocalKey {
+	// IMPORTANT: This is the key for the empty "" password just hittig return:
+	key, _ := hex.DecodeString("f54d6aba8329dea96d4b3daa8caaa05e06bd10c246a40d510d2feb3e73b620bb")
+	return key
+}
+
 func SetupTest(t *testing.T) func() {
 	setupTestBottom()
 	return teardownTest
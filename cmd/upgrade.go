@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"loki/config"
+	"loki/crypto"
+	"loki/log"
+	"loki/record"
+	"loki/subcommand"
+	"loki/tree"
+	"loki/utils"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Upgrade rewrites all records of the store in the newest datafile format using the same key and generation.
+// With --dry-run nothing is written. The upgrade is refused if the store contains records of different generations.
+func Upgrade(cfg config.Configuration, subcommand subcommand.Subcommand, args ...string) error {
+
+	flags := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Only report what would be converted.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return errors.New("Too many arguments given")
+	}
+
+	base := cfg.SystemDirectory()
+
+	if !utils.CheckBase(cfg) {
+		return errors.New("could not find basedir")
+	}
+
+	headers, err := collectHeaders(base)
+
+	if err != nil {
+		return err
+	}
+
+	if err := verifySingleGeneration(headers); err != nil {
+		return err
+	}
+
+	// stores without key check get one after upgrading, the password has to be confirmed for it
+	key, err := utils.GetMasterkey(cfg, !utils.HasKeyCheck(cfg.GetMasterfilename()))
+
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		log.Info("Dry run, upgrading records to format version %d:\n", record.LokiFormatVersion)
+	} else {
+		log.Info("Upgrading records to format version %d:\n", record.LokiFormatVersion)
+	}
+
+	converted, skipped, failed := 0, 0, 0
+
+	for _, path := range sortedPaths(headers) {
+		relPath := strings.TrimPrefix(path, base+string(os.PathSeparator))
+		version := headers[path].FormatVersion
+
+		if version == record.LokiFormatVersion {
+			log.Debug("Skipping: %s", relPath)
+			skipped++
+			continue
+		}
+
+		rec, hdr, err := record.LoadRecord(path, key)
+
+		if err == nil && !*dryRun {
+			err = record.RewriteRecord(path, hdr.Generation, upgradeKey(path, version, key), rec)
+		}
+
+		if err != nil {
+			log.Error("Failed   : %s: %v", relPath, err)
+			failed++
+			continue
+		}
+
+		log.Info("Converted: %s (v%d -> v%d)", relPath, version, record.LokiFormatVersion)
+		converted++
+	}
+
+	log.Info("\nConverted: %d, skipped: %d, failed: %d", converted, skipped, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d records could not be upgraded", failed)
+	}
+
+	if !*dryRun {
+		if err := utils.StoreKeyCheck(cfg.GetMasterfilename(), key); err != nil {
+			return err
+		}
+
+		if err := utils.AddStoreID(cfg.GetMasterfilename()); err != nil {
+			return err
+		}
+
+		if masterfile, err := utils.LoadMasterfile(cfg.GetMasterfilename()); err == nil {
+			cfg.StoreID = masterfile.StoreId
+		}
+	}
+
+	utils.SetupKeyAgent(cfg, key)
+	return nil
+}
+
+// upgradeKey returns the key-encryption key the record given with path is rewritten with. Records written by
+// recipients without the masterpassword are not wrapped for the masterkey and stay this way.
+func upgradeKey(path string, version uint32, key crypto.Key) crypto.Key {
+	if key == nil || version < record.LokiFormatVersion4 {
+		return key
+	}
+
+	if protected, err := record.CheckKey(path, key); err == nil && !protected {
+		return nil
+	}
+
+	return key
+}
+
+// collectHeaders returns the headers of all loki-files in the tree given by dir keyed by their path.
+func collectHeaders(dir string) (map[string]*record.DataFileHeader, error) {
+	headers := make(map[string]*record.DataFileHeader)
+	var outError error
+
+	tree.FilteredWalk(dir, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() {
+			return nil
+		}
+
+		hdr, err := record.LoadHeader(path)
+
+		if err != nil {
+			outError = fmt.Errorf("%s: %v", path, err)
+			return err
+		}
+
+		headers[path] = hdr
+		return nil
+	})
+
+	return headers, outError
+}
+
+// verifySingleGeneration makes sure all headers carry the same generation. A mixed store is the
+// result of an interrupted change and should be repaired before upgrading.
+func verifySingleGeneration(headers map[string]*record.DataFileHeader) error {
+	generations := make(map[uint32]int)
+
+	for _, hdr := range headers {
+		generations[hdr.Generation]++
+	}
+
+	if len(generations) > 1 {
+		for generation, count := range generations {
+			log.Error("Generation %d: %d records", generation, count)
+		}
+		return errors.New("Records of different generations found, refusing to upgrade")
+	}
+
+	return nil
+}
+
+func sortedPaths(headers map[string]*record.DataFileHeader) []string {
+	paths := make([]string, 0, len(headers))
+
+	for path := range headers {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
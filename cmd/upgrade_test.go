@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"loki/record"
+	"testing"
+)
+
+func TestUpgradeDryRun(t *testing.T) {
+	defer SetupTest(t)()
+	if err := Upgrade(cfg, cmd, "--dry-run"); err != nil {
+		t.Fail()
+	}
+
+	if hdr, err := record.LoadHeader(TBASE() + "file1.loki"); err != nil || hdr.FormatVersion != record.LokiFormatVersion1 {
+		t.Fail()
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	defer SetupTest(t)()
+	if err := Upgrade(cfg, cmd); err != nil {
+		t.Fail()
+	}
+
+	for _, filename := range []string{"file1.loki", "dir3" + SEP + "sub" + SEP + "bingo.loki"} {
+		if hdr, err := record.LoadHeader(TBASE() + filename); err != nil || hdr.FormatVersion != record.LokiFormatVersion {
+			t.Fail()
+		}
+	}
+
+	if err := Show(cfg, cmd, "file1"); err != nil {
+		t.Fail()
+	}
+}
+
+func TestUpgradeMixedGenerations(t *testing.T) {
+	defer SetupTest(t)()
+
+	rec, _, err := record.LoadRecord(TBASE()+"file2.loki", testKey())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record.WriteRecord(TBASE()+"file2.loki", 2, testKey(), rec)
+
+	if err := Upgrade(cfg, cmd); err == nil {
+		t.Fail()
+	}
+}
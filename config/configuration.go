@@ -57,6 +57,7 @@ type FlagBundle struct {
 	Blindmode      boolFlag
 	Debug          boolFlag
 	Help           boolFlag
+	Keyfile        string
 }
 
 // Configuration is the system configuration as created by merging config-file values and
@@ -66,10 +67,26 @@ type Configuration struct {
 	Binpath        string
 	Gitmode        bool
 	Generation     uint32
+	StoreID        string // taken from the masterfile
 	Loglevel       string
 	ExternalEditor bool
 	Clipboard      bool
 	Blindmode      bool
+	Cipher         string
+	Padding        string
+	History        string // number of earlier passwords kept per record
+	IdleTimeout    string // duration the agent keeps the key without requests, "0" disables
+	MaxLifetime    string // duration the agent keeps the key at all, "0" disables
+	CheckCaller    bool   // the agent answers the loki binary only
+	SealedAgent    bool   // the agent encrypts and decrypts, it never hands out the key
+	ConfirmAgent   bool   // every use of a key has to be confirmed at the agent
+	ConfirmHelper  string // program asked for the confirmation instead of the terminal of the agent
+	ConfirmGrace   string // duration a confirmation covers the further requests of a process, "0" asks every time
+	AgentSocket    string // overrides the socket in the runtime directory
+	AgentLog       string // overrides the logfile of the agent in the state directory
+	Identity       string
+	Keyfile        string
+	HiddenNames    bool // taken from the masterfile
 }
 
 // ParseFlags defines all flags the program understands, parses the commandline into them and
@@ -81,10 +98,11 @@ func ParseFlags() FlagBundle {
 
 	flag.Var(&fb.ExternalEditor, "e", "Use external editor given in the EDITOR environment variable.")
 	flag.Var(&fb.Gitmode, "g", "Automatically run git commit after each modifiying command.")
-	flag.Var(&fb.Clipboard, "c", "Copy password to clipboard")
+	flag.Var(&fb.Clipboard, "c", "Copy password or one-time password to clipboard")
 	flag.Var(&fb.Blindmode, "b", "Blindmode. Do not show password.")
 	flag.Var(&fb.Debug, "d", "Debug mode. Equivalent to -l debug.")
 	flag.Var(&fb.Help, "h", "Show help information.")
+	flag.StringVar(&fb.Keyfile, "k", "", "Keyfile needed in addition to the masterpassword.")
 
 	flag.Parse()
 
@@ -137,6 +155,11 @@ func New(fb FlagBundle) Configuration {
 		cfg.Blindmode = fb.Blindmode.value
 	}
 
+	// the working directory changes to the store later on
+	if len(fb.Keyfile) > 0 {
+		cfg.Keyfile, _ = filepath.Abs(fb.Keyfile)
+	}
+
 	return cfg
 }
 
@@ -144,10 +167,26 @@ func New(fb FlagBundle) Configuration {
 func (c *Configuration) Print() {
 	log.Debug("Binpath    : %s", c.Binpath)
 	log.Debug("Generation : %d", c.Generation)
+	log.Debug("Store ID   : %s", c.StoreID)
 
 	log.Debug("Gitmode    : %t", c.Gitmode)
 	log.Debug("Clipboard  : %t", c.Clipboard)
 	log.Debug("ExtEditor  : %t", c.ExternalEditor)
+	log.Debug("Cipher     : %s", c.Cipher)
+	log.Debug("Padding    : %s", c.Padding)
+	log.Debug("History    : %s", c.History)
+	log.Debug("Idle       : %s", c.IdleTimeout)
+	log.Debug("Lifetime   : %s", c.MaxLifetime)
+	log.Debug("Caller chk : %t", c.CheckCaller)
+	log.Debug("Sealed     : %t", c.SealedAgent)
+	log.Debug("Confirm    : %t", c.ConfirmAgent)
+	log.Debug("Conf helper: %s", c.ConfirmHelper)
+	log.Debug("Conf grace : %s", c.ConfirmGrace)
+	log.Debug("Socket     : %s", c.GetSocketfilePath())
+	log.Debug("Agent log  : %s", c.GetAgentLogfilePath())
+	log.Debug("Identity   : %s", c.GetIdentityFilename())
+	log.Debug("Keyfile    : %s", c.Keyfile)
+	log.Debug("Hidden     : %t", c.HiddenNames)
 	log.Debug("Loglevel   : %s\n", c.Loglevel)
 }
 
@@ -177,8 +216,67 @@ func (c *Configuration) GetMasterfilename() string {
 	return getSystemDirectory() + string(os.PathSeparator) + MasterFilename
 }
 
-func GetSocketfilePath() string {
-	return fmt.Sprintf(CommunicationFile, os.Getuid())
+// GetIdentityFilename returns the full path to the users identity file holding the private key for team stores.
+// The LOKI_IDENTITY environment variable takes precedence over the configfile. Usually: ~/.loki-identity.
+func (c *Configuration) GetIdentityFilename() string {
+	if identityVar := os.Getenv(LokiIdentityEnv); len(identityVar) > 0 {
+		return identityVar
+	}
+
+	if len(c.Identity) > 0 {
+		return c.Identity
+	}
+
+	usr, _ := user.Current()
+	return filepath.Join(usr.HomeDir, IdentityFilename)
+}
+
+// GetSocketfilePath returns the full path to the socket of the agent. The LOKI_AGENT_SOCKET environment variable
+// takes precedence over the configfile. Usually: $XDG_RUNTIME_DIR/loki/agent.sock.
+func (c *Configuration) GetSocketfilePath() string {
+	if socketVar := os.Getenv(LokiSocketEnv); len(socketVar) > 0 {
+		return socketVar
+	}
+
+	if len(c.AgentSocket) > 0 {
+		return c.AgentSocket
+	}
+
+	return DefaultSocketfilePath()
+}
+
+// GetAgentLogfilePath returns the full path to the logfile of the agent. The LOKI_AGENT_LOG environment variable
+// takes precedence over the configfile. Usually: ~/.local/state/loki/agentd.log.
+func (c *Configuration) GetAgentLogfilePath() string {
+	if logVar := os.Getenv(LokiAgentLogEnv); len(logVar) > 0 {
+		return logVar
+	}
+
+	if len(c.AgentLog) > 0 {
+		return c.AgentLog
+	}
+
+	return DefaultAgentLogfilePath()
+}
+
+// DefaultSocketfilePath returns the socket in the runtime directory of the user. Without one a directory of the user
+// in the temporary directory is used, e.g. /tmp/loki-1000/agent.sock.
+func DefaultSocketfilePath() string {
+	if runtimeDir := os.Getenv(RuntimeDirEnv); len(runtimeDir) > 0 {
+		return filepath.Join(runtimeDir, AgentDirectory, SocketFilename)
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf(TempAgentDir, os.Getuid()), SocketFilename)
+}
+
+// DefaultAgentLogfilePath returns the logfile in the state directory of the user.
+func DefaultAgentLogfilePath() string {
+	if stateDir := os.Getenv(StateDirEnv); len(stateDir) > 0 {
+		return filepath.Join(stateDir, AgentDirectory, AgentLogFilename)
+	}
+
+	usr, _ := user.Current()
+	return filepath.Join(usr.HomeDir, StateDirectory, AgentDirectory, AgentLogFilename)
 }
 
 func getSystemDirectory() string {
@@ -1,5 +1,13 @@
 package config
 
+import "time"
+
+// Defaults of the agent, the configfile overrides them.
+const (
+	DefaultIdleTimeout = 15 * time.Minute // the agent exits when the key was not requested for this long
+	DefaultMaxLifetime = 8 * time.Hour    // the agent exits after this time in any case
+)
+
 // Systemwide constants used all over the place.
 const (
 	InnerMagic        = "LOKI" // Fixed magic value provided in any record to verify successful decryption (with hash)
@@ -8,25 +16,61 @@ const (
 	FileSuffix        = ".loki"
 	ConfigFilename    = ".config"
 	MasterFilename    = ".master"
+	RecipientsFile    = ".recipients"
+	IndexFilename     = ".index"
+	IdentityFilename  = ".loki-identity"
 	LokiBaseEnv       = "LOKI_BASE"
 	LokiEditorEnv     = "EDITOR"
 	LokiLoglevelEnv   = "LOKI_LOGLEVEL"
-	CommunicationFile = "/tmp/loki-%d.sock"
+	LokiIdentityEnv   = "LOKI_IDENTITY"
+	LokiSocketEnv     = "LOKI_AGENT_SOCKET"
+	LokiAgentLogEnv   = "LOKI_AGENT_LOG"
+	RuntimeDirEnv     = "XDG_RUNTIME_DIR"
+	StateDirEnv       = "XDG_STATE_HOME"
+	AgentDirectory    = "loki"         // below the runtime and the state directory
+	TempAgentDir      = "loki-%d"      // below the temporary directory if there is no runtime directory
+	StateDirectory    = ".local/state" // below the home directory if XDG_STATE_HOME is not set
+	SocketFilename    = "agent.sock"
+	AgentLogFilename  = "agentd.log"
 	ConfigTemplate    = "configfile.tmpl"
 	ConfigTemplateGit = "configfile-git.tmpl"
-	RequestMagic      = "req"
-	ShutdownMagic     = "shutdown"
-	AgentLogfile      = "/tmp/loki-apentd.log"
 	KeyLength         = 32
+	DefaultPadding    = "pow2"     // padding written to the configfile of new stores
+	SecretMask        = "********" // shown for secrets in Blindmode, the same for any length
 
-	MagicLabel    = "Magic       : "
-	MD5Label      = "MD5         : "
-	TitleLabel    = "Title       : "
-	AccountLabel  = "Account     : "
-	PasswordLabel = "Password    : "
-	TagsLabel     = "Tags        : "
-	URLLabel      = "Url         : "
-	NotesLabel    = "Notes       : "
+	MagicLabel      = "Magic       : "
+	MD5Label        = "MD5         : "
+	TitleLabel      = "Title       : "
+	AccountLabel    = "Account     : "
+	PasswordLabel   = "Password    : "
+	TagsLabel       = "Tags        : "
+	URLLabel        = "Url         : "
+	NotesLabel      = "Notes       : "
+	FieldLabel      = "Field       : "
+	ValueLabel      = "Value       : "
+	ConcealLabel    = "Concealed   : "
+	OTPLabel        = "OTP         : "
+	ExpiresLabel    = "Expires     : "
+	CreatedLabel    = "Created     : "
+	ModifiedLabel   = "Modified    : "
+	ChangedLabel    = "Pw changed  : "
+	TypeLabel       = "Type        : "
+	CardholderLabel = "Cardholder  : "
+	NumberLabel     = "Number      : "
+	ValidThruLabel  = "Valid thru  : "
+	CVVLabel        = "CVV         : "
+	PINLabel        = "PIN         : "
+	PrivateKeyLabel = "Private key : "
+	PassphraseLabel = "Passphrase  : "
+	PublicKeyLabel  = "Public key  : "
+	NameLabel       = "Name        : "
+	EmailLabel      = "Email       : "
+	PhoneLabel      = "Phone       : "
+	AddressLabel    = "Address     : "
+	BirthdayLabel   = "Birthday    : "
+	AttachmentLabel = "Attachment  : "
+	DateFormat      = "2006-01-02"
+	TimeFormat      = "2006-01-02 15:04"
 
 	ExitCodeOK      = 0
 	ExitCodeFailure = 1
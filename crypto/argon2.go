@@ -2,10 +2,59 @@ package crypto
 
 import (
 	"golang.org/x/crypto/argon2"
+	"time"
 )
 
-// Argon2KDF produces a fixed length (32 bytes) key from the given password using the Argon2 Key derivation algorythm
-func Argon2KDF(password []byte) []byte {
+// Default costs for newly created stores. Memory is given in KiB.
+const (
+	Argon2DefaultTime    uint32 = 3
+	Argon2DefaultMemory  uint32 = 64 * 1024
+	Argon2DefaultThreads uint8  = 4
+	Argon2KeyLength      uint32 = 32
+	Argon2SaltLength            = 16
+)
+
+// Argon2KDF produces a fixed length (32 bytes) key from the given password using the Argon2id key derivation algorythm
+// with the given salt and cost parameters.
+func Argon2KDF(password []byte, salt []byte, time uint32, memory uint32, threads uint8) []byte {
+	return argon2.IDKey(password, salt, time, memory, threads, Argon2KeyLength)
+}
+
+// LegacyArgon2KDF produces a fixed length (32 bytes) key from the given password the way loki did before the
+// KDF parameters were kept in the masterfile: Argon2i with one hard-coded salt and fixed costs.
+func LegacyArgon2KDF(password []byte) []byte {
 	salt := []byte{0x4F, 0xEB, 0x43, 0xDB, 0xBE, 0xB0, 0x43, 0x5C, 0x86, 0xC9, 0x7F, 0xA8, 0x9B, 0x4B, 0xDB, 0x0C}
-	return argon2.Key(password, salt, 3, 32*1024, 4, 32)
+	return argon2.Key(password, salt, 3, 32*1024, 4, Argon2KeyLength)
+}
+
+// Argon2MinimumMemory is the lower bound (in KiB) CalibrateArgon2 reduces the memory to.
+const Argon2MinimumMemory uint32 = 8 * 1024
+
+// CalibrateArgon2 benchmarks Argon2KDF on this machine and returns iterations and memory (KiB) which take
+// about the target duration, together with the measured duration. The memory given is halved until a single
+// iteration fits into the target, the iterations are raised afterwards.
+func CalibrateArgon2(target time.Duration, memory uint32, threads uint8) (uint32, uint32, time.Duration) {
+	iterations := uint32(1)
+	elapsed := MeasureArgon2(iterations, memory, threads)
+
+	for elapsed > target && memory/2 >= Argon2MinimumMemory {
+		memory /= 2
+		elapsed = MeasureArgon2(iterations, memory, threads)
+	}
+
+	// the runtime of Argon2 grows linear with the number of iterations
+	if elapsed < target {
+		iterations = uint32(target / elapsed)
+		elapsed = MeasureArgon2(iterations, memory, threads)
+	}
+
+	return iterations, memory, elapsed
+}
+
+// MeasureArgon2 returns the time one key derivation with the given costs takes on this machine.
+func MeasureArgon2(iterations uint32, memory uint32, threads uint8) time.Duration {
+	salt := make([]byte, Argon2SaltLength)
+	start := time.Now()
+	Argon2KDF([]byte("calibration"), salt, iterations, memory, threads)
+	return time.Since(start)
 }
@@ -1,9 +1,11 @@
 package crypto
 
 import (
+	"bytes"
 	"encoding/hex"
 	"loki/log"
 	"testing"
+	"time"
 )
 
 func TestArgon2hashes(t *testing.T) {
@@ -12,7 +14,7 @@ func TestArgon2hashes(t *testing.T) {
 	passwords := []string{"x", "m", "mm", "Matthias"}
 
 	for _, password := range passwords {
-		key := Argon2KDF([]byte(password))
+		key := LegacyArgon2KDF([]byte(password))
 		log.Debug("Key: " + hexdump(key) + ", password: " + password)
 	}
 
@@ -20,6 +22,62 @@ func TestArgon2hashes(t *testing.T) {
 
 }
 
+func TestLegacyKeyDerivator(t *testing.T) {
+	kdf, err := NewKeyDerivator(KDFParameters{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// This is the key for the empty "" password used by the testdata
+	if hexdump(kdf([]byte(""))) != "f54d6aba8329dea96d4b3daa8caaa05e06bd10c246a40d510d2feb3e73b620bb" {
+		t.Fail()
+	}
+}
+
+func TestSaltedKeyDerivator(t *testing.T) {
+	p1, _ := NewKDFParametersWithCosts(1, 64, 1)
+	p2, _ := NewKDFParametersWithCosts(1, 64, 1)
+
+	if bytes.Equal(p1.Salt, p2.Salt) {
+		t.Fatal("two stores got the same salt")
+	}
+
+	kdf1, err := NewKeyDerivator(p1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kdf2, _ := NewKeyDerivator(p2)
+
+	if bytes.Equal(kdf1([]byte("secret")), kdf2([]byte("secret"))) {
+		t.Fail()
+	}
+
+	if !bytes.Equal(kdf1([]byte("secret")), Argon2KDF([]byte("secret"), p1.Salt, 1, 64, 1)) {
+		t.Fail()
+	}
+}
+
+func TestInvalidKeyDerivator(t *testing.T) {
+	if _, err := NewKeyDerivator(KDFParameters{Name: "scrypt", Salt: make([]byte, 16)}); err == nil {
+		t.Fail()
+	}
+
+	if _, err := NewKeyDerivator(KDFParameters{Name: KDFArgon2id, Salt: make([]byte, 16)}); err == nil {
+		t.Fail()
+	}
+}
+
+func TestCalibrateArgon2(t *testing.T) {
+	iterations, memory, elapsed := CalibrateArgon2(20*time.Millisecond, Argon2MinimumMemory, 1)
+
+	if iterations < 1 || memory != Argon2MinimumMemory || elapsed <= 0 {
+		t.Fail()
+	}
+}
+
 // Hexdump provides a string with the hex-representation of the byte-array given in data.
 func hexdump(data []byte) string {
 	return hex.EncodeToString(data)
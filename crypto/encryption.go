@@ -4,48 +4,162 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher identifies the cryptographic algorythm a payload is encrypted with. It is stored in the header of every
+// datafile, so the numbers must never change.
+type Cipher uint32
+
+// All ciphers known to the system.
+const (
+	CipherAES256GCM         Cipher = 1
+	CipherXChaCha20Poly1305 Cipher = 2
 )
 
-// Engine is an abstraction over the actuall cryptographic algorythm/scheme used.
+var cipherNames = map[Cipher]string{
+	CipherAES256GCM:         "aes-256-gcm",
+	CipherXChaCha20Poly1305: "xchacha20-poly1305",
+}
+
+func (c Cipher) String() string {
+	if name, ok := cipherNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown cipher %d", uint32(c))
+}
+
+// CipherFromName returns the cipher with the given name as used in the configfile. An empty name
+// gives the systems default: AES-256-GCM.
+func CipherFromName(name string) (Cipher, error) {
+	if len(name) == 0 {
+		return CipherAES256GCM, nil
+	}
+
+	for c, n := range cipherNames {
+		if strings.EqualFold(n, name) {
+			return c, nil
+		}
+	}
+
+	return 0, errors.New("unknown cipher: " + name)
+}
+
+// KeySize is the size of the keys used by all engines.
+const KeySize = 32
+
+// NewRandomKey returns a fresh random key to be used with any engine.
+func NewRandomKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return []byte{}, err
+	}
+
+	return key, nil
+}
+
+// Engine is an abstraction over the actuall cryptographic algorythm/scheme used. The additionalData is
+// authenticated but not encrypted, it might be nil.
 type Engine interface {
-	Encrypt(data []byte, key []byte) ([]byte, error)
-	Decrypt(data []byte, key []byte) ([]byte, error)
+	Encrypt(data []byte, key []byte, additionalData []byte) ([]byte, error)
+	Decrypt(data []byte, key []byte, additionalData []byte) ([]byte, error)
+	Cipher() Cipher // the identifier of the algorythm
 }
 
-// NewEngine creates a new cryptographic engine. As of now, this is AES.
+// NewEngine creates a new cryptographic engine using the systems default cipher: AES.
 func NewEngine() Engine {
 	return &aesEngine{}
 }
 
+// NewEngineForCipher creates the cryptographic engine for the given cipher.
+func NewEngineForCipher(c Cipher) (Engine, error) {
+	switch c {
+	case CipherAES256GCM:
+		return &aesEngine{}, nil
+	case CipherXChaCha20Poly1305:
+		return &xchachaEngine{}, nil
+	}
+	return nil, errors.New("unsupported cipher: " + c.String())
+}
+
 type aesEngine struct{}
 
-func (*aesEngine) Encrypt(data []byte, key []byte) ([]byte, error) {
-	block, _ := aes.NewCipher(key)
-	gcm, err := cipher.NewGCM(block)
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (*aesEngine) Cipher() Cipher {
+	return CipherAES256GCM
+}
+
+func (*aesEngine) Encrypt(data []byte, key []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
 		return []byte{}, err
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+	return seal(gcm, data, additionalData)
+}
+
+func (*aesEngine) Decrypt(data []byte, key []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
 		return []byte{}, err
 	}
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	return open(gcm, data, additionalData)
 }
 
-func (*aesEngine) Decrypt(data []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// xchachaEngine uses a 24 byte random nonce, which is large enough to never collide no matter
+// how often a store gets re-encrypted.
+type xchachaEngine struct{}
+
+func (*xchachaEngine) Cipher() Cipher {
+	return CipherXChaCha20Poly1305
+}
+
+func (*xchachaEngine) Encrypt(data []byte, key []byte, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
 	if err != nil {
 		return []byte{}, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	return seal(aead, data, additionalData)
+}
+
+func (*xchachaEngine) Decrypt(data []byte, key []byte, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
 	if err != nil {
 		return []byte{}, err
 	}
-	nonceSize := gcm.NonceSize()
+	return open(aead, data, additionalData)
+}
+
+// seal encrypts data with a random nonce which is prepended to the ciphertext.
+func seal(aead cipher.AEAD, data []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return []byte{}, err
+	}
+	ciphertext := aead.Seal(nonce, nonce, data, additionalData)
+	return ciphertext, nil
+}
+
+// open decrypts data which has the nonce prepended.
+func open(aead cipher.AEAD, data []byte, additionalData []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return []byte{}, errors.New("ciphertext too short")
+	}
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -0,0 +1,70 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEngines(t *testing.T) {
+	key := bytes.Repeat([]byte{0x17}, 32)
+	data := []byte("Here is a string....")
+	ad := []byte("header")
+
+	// nonce and tag are added to the ciphertext
+	overhead := map[Cipher]int{CipherAES256GCM: 12 + 16, CipherXChaCha20Poly1305: 24 + 16}
+
+	for _, c := range []Cipher{CipherAES256GCM, CipherXChaCha20Poly1305} {
+		e, err := NewEngineForCipher(c)
+
+		if err != nil || e.Cipher() != c {
+			t.Fatal(err)
+		}
+
+		encrypted, err := e.Encrypt(data, key, ad)
+
+		if err != nil || len(encrypted) != len(data)+overhead[c] {
+			t.Fatalf("%s: %v", c, err)
+		}
+
+		if decrypted, err := e.Decrypt(encrypted, key, ad); err != nil || !bytes.Equal(decrypted, data) {
+			t.Fatalf("%s: %v", c, err)
+		}
+
+		if _, err := e.Decrypt(encrypted, key, []byte("other")); err == nil {
+			t.Fatalf("%s: additional data not authenticated", c)
+		}
+	}
+}
+
+func TestCipherFromName(t *testing.T) {
+	if c, err := CipherFromName(""); err != nil || c != CipherAES256GCM {
+		t.Fail()
+	}
+
+	if c, err := CipherFromName("XChaCha20-Poly1305"); err != nil || c != CipherXChaCha20Poly1305 {
+		t.Fail()
+	}
+
+	if _, err := CipherFromName("rot13"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestKeyCheck(t *testing.T) {
+	key, _ := NewRandomKey()
+	other, _ := NewRandomKey()
+
+	check, err := NewKeyCheck(LocalKey(key), 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !VerifyKeyCheck(check, LocalKey(key), 3) {
+		t.Error("valid key rejected")
+	}
+
+	if VerifyKeyCheck(check, LocalKey(other), 3) || VerifyKeyCheck(check, LocalKey(key), 4) {
+		t.Error("invalid key or generation accepted")
+	}
+}
@@ -1,9 +1,66 @@
 package crypto
 
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Names of the key derivation functions which could be recorded in the masterfile.
+const (
+	KDFLegacy   = ""
+	KDFArgon2id = "argon2id"
+)
+
 // KeyDerivator defines a type which turns a password given as byte-array into a fixed-sized key returned as byte-array as well.
 type KeyDerivator func(password []byte) []byte
 
-// NewKeyDerivator produces the systems default KeyDerivator: Argon2KDF
-func NewKeyDerivator() KeyDerivator {
-	return Argon2KDF
+// KDFParameters holds everything needed to rebuild the KeyDerivator of a store. They are kept in the masterfile.
+type KDFParameters struct {
+	Name    string
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Keyfile bool // the password is combined with a keyfile, see WithKeyfile
+}
+
+// NewKDFParameters creates the parameters for a brand new store: Argon2id with default costs and a random salt.
+func NewKDFParameters() (KDFParameters, error) {
+	return NewKDFParametersWithCosts(Argon2DefaultTime, Argon2DefaultMemory, Argon2DefaultThreads)
+}
+
+// NewKDFParametersWithCosts creates Argon2id parameters with the given costs and a fresh random salt.
+func NewKDFParametersWithCosts(time uint32, memory uint32, threads uint8) (KDFParameters, error) {
+	salt := make([]byte, Argon2SaltLength)
+
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KDFParameters{}, err
+	}
+
+	return KDFParameters{Name: KDFArgon2id, Salt: salt, Time: time, Memory: memory, Threads: threads}, nil
+}
+
+// IsLegacy returns true if these parameters describe a store created without a salt in the masterfile.
+func (p KDFParameters) IsLegacy() bool {
+	return p.Name == KDFLegacy && len(p.Salt) == 0
+}
+
+// NewKeyDerivator produces the KeyDerivator described by the given parameters. Legacy parameters produce LegacyArgon2KDF.
+func NewKeyDerivator(p KDFParameters) (KeyDerivator, error) {
+	if p.IsLegacy() {
+		return LegacyArgon2KDF, nil
+	}
+
+	if p.Name != KDFArgon2id {
+		return nil, errors.New("unknown key derivation function: " + p.Name)
+	}
+
+	if len(p.Salt) < Argon2SaltLength || p.Time < 1 || p.Memory < 8*uint32(p.Threads) || p.Threads < 1 {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+
+	return func(password []byte) []byte {
+		return Argon2KDF(password, p.Salt, p.Time, p.Memory, p.Threads)
+	}, nil
 }
@@ -0,0 +1,21 @@
+package crypto
+
+// Key encrypts and decrypts with a key the caller does not necessarily hold itself. A LocalKey is kept in the
+// memory of the process, while the agent keeps the masterkey to itself and performs the operations on request.
+type Key interface {
+	Encrypt(e Engine, data []byte, additionalData []byte) ([]byte, error)
+	Decrypt(e Engine, data []byte, additionalData []byte) ([]byte, error)
+}
+
+// LocalKey is a key held in the memory of the process.
+type LocalKey []byte
+
+// Encrypt encrypts data with the key using the given engine.
+func (k LocalKey) Encrypt(e Engine, data []byte, additionalData []byte) ([]byte, error) {
+	return e.Encrypt(data, k, additionalData)
+}
+
+// Decrypt decrypts data with the key using the given engine.
+func (k LocalKey) Decrypt(e Engine, data []byte, additionalData []byte) ([]byte, error) {
+	return e.Decrypt(data, k, additionalData)
+}
@@ -0,0 +1,28 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// keyCheckValue is the known plaintext of the key check, the key itself is never stored.
+var keyCheckValue = []byte("loki key check")
+
+// NewKeyCheck encrypts a known value with the given key. The generation is authenticated as well, so a key check
+// is only valid for the generation it was created for.
+func NewKeyCheck(key Key, generation uint32) ([]byte, error) {
+	return key.Encrypt(NewEngine(), keyCheckValue, generationData(generation))
+}
+
+// VerifyKeyCheck returns true if the key check was created by NewKeyCheck with the very same key and generation.
+func VerifyKeyCheck(check []byte, key Key, generation uint32) bool {
+	value, err := key.Decrypt(NewEngine(), check, generationData(generation))
+
+	return err == nil && bytes.Equal(value, keyCheckValue)
+}
+
+func generationData(generation uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, generation)
+	return data
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// KeyfileSize is the number of random bytes in a keyfile created by NewKeyfile.
+const KeyfileSize = 64
+
+// NewKeyfile creates a keyfile filled with random bytes at path. An existing file is never overwritten.
+func NewKeyfile(path string) error {
+	data := make([]byte, KeyfileSize)
+
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// HashKeyfile returns the SHA-256 hash of the file given with path. Any file could be used as keyfile.
+func HashKeyfile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// WithKeyfile turns the KeyDerivator into one for a composite key: the password is hashed together with the
+// hash of the keyfile before it is passed to the given KeyDerivator.
+func WithKeyfile(kdf KeyDerivator, keyfileHash []byte) KeyDerivator {
+	return func(password []byte) []byte {
+		passwordHash := sha256.Sum256(password)
+		composite := sha256.Sum256(append(passwordHash[:], keyfileHash...))
+		return kdf(composite[:])
+	}
+}
@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyfile(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "loki_keyfile_test")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+
+	if err := NewKeyfile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewKeyfile(path); err == nil {
+		t.Error("existing keyfile overwritten")
+	}
+
+	hash, err := HashKeyfile(path)
+
+	if err != nil || len(hash) != 32 {
+		t.Fatal(err)
+	}
+
+	kdf := func(password []byte) []byte { return password }
+	composite := WithKeyfile(kdf, hash)
+
+	if bytes.Equal(composite([]byte("password")), kdf([]byte("password"))) {
+		t.Error("keyfile not mixed in")
+	}
+
+	if !bytes.Equal(composite([]byte("password")), composite([]byte("password"))) {
+		t.Error("composite key not deterministic")
+	}
+}
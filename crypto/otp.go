@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTP is a one-time password generator as described by an otpauth:// URI, the format used by the QR codes of
+// most services: otpauth://totp/Issuer:account?secret=BASE32&issuer=Issuer&algorithm=SHA1&digits=6&period=30
+type OTP struct {
+	Type      string // "totp" (RFC 6238) or "hotp" (RFC 4226)
+	Label     string
+	Issuer    string
+	Secret    []byte
+	Algorithm string
+	Digits    int
+	Period    int    // totp only
+	Counter   uint64 // hotp only, the counter of the next code
+}
+
+var otpAlgorithms = map[string]func() hash.Hash{
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// ParseOTP parses an otpauth:// URI. Anything in front of the URI is skipped, so the text decoded from a QR
+// code could be given as it is, e.g. "QR-Code:otpauth://...".
+func ParseOTP(uri string) (*OTP, error) {
+	if i := strings.Index(uri, "otpauth://"); i >= 0 {
+		uri = uri[i:]
+	}
+
+	u, err := url.Parse(strings.TrimSpace(uri))
+
+	if err != nil || u.Scheme != "otpauth" {
+		return nil, errors.New("no otpauth URI")
+	}
+
+	q := u.Query()
+
+	otp := &OTP{
+		Type:      strings.ToLower(u.Host),
+		Label:     strings.TrimPrefix(u.Path, "/"),
+		Issuer:    q.Get("issuer"),
+		Algorithm: strings.ToUpper(q.Get("algorithm")),
+		Digits:    6,
+		Period:    30,
+	}
+
+	if otp.Type != "totp" && otp.Type != "hotp" {
+		return nil, errors.New("unknown otp type: " + u.Host)
+	}
+
+	secret := strings.ToUpper(strings.ReplaceAll(q.Get("secret"), " ", ""))
+
+	if otp.Secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "=")); err != nil || len(otp.Secret) == 0 {
+		return nil, errors.New("invalid otp secret")
+	}
+
+	if len(otp.Algorithm) == 0 {
+		otp.Algorithm = "SHA1"
+	}
+
+	if _, ok := otpAlgorithms[otp.Algorithm]; !ok {
+		return nil, errors.New("unknown otp algorithm: " + otp.Algorithm)
+	}
+
+	if digits := q.Get("digits"); len(digits) > 0 {
+		if otp.Digits, err = strconv.Atoi(digits); err != nil || otp.Digits < 6 || otp.Digits > 10 {
+			return nil, errors.New("invalid otp digits: " + digits)
+		}
+	}
+
+	if period := q.Get("period"); len(period) > 0 {
+		if otp.Period, err = strconv.Atoi(period); err != nil || otp.Period < 1 {
+			return nil, errors.New("invalid otp period: " + period)
+		}
+	}
+
+	if counter := q.Get("counter"); len(counter) > 0 {
+		if otp.Counter, err = strconv.ParseUint(counter, 10, 64); err != nil {
+			return nil, errors.New("invalid otp counter: " + counter)
+		}
+	} else if otp.Type == "hotp" {
+		return nil, errors.New("hotp without counter")
+	}
+
+	return otp, nil
+}
+
+// URI returns the otpauth:// URI of the generator, including the current counter of HOTP generators.
+func (otp *OTP) URI() string {
+	q := url.Values{}
+	q.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(otp.Secret))
+
+	if len(otp.Issuer) > 0 {
+		q.Set("issuer", otp.Issuer)
+	}
+
+	q.Set("algorithm", otp.Algorithm)
+	q.Set("digits", strconv.Itoa(otp.Digits))
+
+	if otp.Type == "hotp" {
+		q.Set("counter", strconv.FormatUint(otp.Counter, 10))
+	} else {
+		q.Set("period", strconv.Itoa(otp.Period))
+	}
+
+	u := url.URL{Scheme: "otpauth", Host: otp.Type, Path: "/" + otp.Label, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// Code returns the TOTP code for the given time and the seconds it is still valid. HOTP generators return the
+// code of the current counter and raise it, the caller has to store the new counter.
+func (otp *OTP) Code(now time.Time) (string, int) {
+	if otp.Type == "hotp" {
+		code := otp.hotp(otp.Counter)
+		otp.Counter++
+		return code, 0
+	}
+
+	step := now.Unix() / int64(otp.Period)
+	left := int(int64(otp.Period) - now.Unix()%int64(otp.Period))
+
+	return otp.hotp(uint64(step)), left
+}
+
+// hotp computes the code for the given counter as described in RFC 4226, section 5.3.
+func (otp *OTP) hotp(counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(otpAlgorithms[otp.Algorithm], otp.Secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := uint64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+
+	modulo := uint64(1)
+
+	for i := 0; i < otp.Digits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", otp.Digits, value%modulo)
+}
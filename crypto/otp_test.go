@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func otpURI(kind string, secret string, query string) string {
+	return "otpauth://" + kind + "/Example:alice?secret=" + base32.StdEncoding.EncodeToString([]byte(secret)) + query
+}
+
+func TestTOTP(t *testing.T) {
+	// test vectors of RFC 6238, appendix B
+	for _, v := range []struct {
+		algorithm string
+		secret    string
+		time      int64
+		code      string
+	}{
+		{"SHA1", "12345678901234567890", 59, "94287082"},
+		{"SHA1", "12345678901234567890", 1111111109, "07081804"},
+		{"SHA256", "12345678901234567890123456789012", 59, "46119246"},
+		{"SHA512", "1234567890123456789012345678901234567890123456789012345678901234", 20000000000, "47863826"},
+	} {
+		otp, err := ParseOTP(otpURI("totp", v.secret, "&digits=8&algorithm="+v.algorithm))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code, left := otp.Code(time.Unix(v.time, 0)); code != v.code || left != 30-int(v.time%30) {
+			t.Errorf("%s at %d: %s, %d seconds left", v.algorithm, v.time, code, left)
+		}
+	}
+}
+
+func TestHOTP(t *testing.T) {
+	// test vectors of RFC 4226, appendix D
+	otp, err := ParseOTP("QR-Code:" + otpURI("hotp", "12345678901234567890", "&counter=0"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"755224", "287082", "359152"} {
+		if code, _ := otp.Code(time.Now()); code != expected {
+			t.Errorf("counter %d: %s", otp.Counter, code)
+		}
+	}
+
+	reparsed, err := ParseOTP(otp.URI())
+
+	if err != nil || reparsed.Counter != 3 || string(reparsed.Secret) != "12345678901234567890" || reparsed.Label != "Example:alice" {
+		t.Errorf("URI not restored: %s", otp.URI())
+	}
+}
+
+func TestParseOTPErrors(t *testing.T) {
+	for _, uri := range []string{
+		"https://example.com",
+		otpURI("motp", "secret", ""),
+		otpURI("hotp", "secret", ""),
+		otpURI("totp", "secret", "&algorithm=MD5"),
+		otpURI("totp", "secret", "&digits=3"),
+		"otpauth://totp/Example?secret=not-base32",
+	} {
+		if _, err := ParseOTP(uri); err == nil {
+			t.Errorf("accepted: %s", uri)
+		}
+	}
+}
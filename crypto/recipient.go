@@ -0,0 +1,133 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// X25519KeySize is the size of public and private X25519 keys.
+const X25519KeySize = 32
+
+const recipientWrapInfo = "loki recipient key wrap"
+
+// Identity is the X25519 key pair of one member of a team store. Data keys are wrapped for the public key,
+// the private key unwraps them again.
+type Identity struct {
+	PublicKey  []byte
+	PrivateKey []byte
+}
+
+// NewIdentity creates a fresh random X25519 key pair.
+func NewIdentity() (*Identity, error) {
+	private, err := randomScalar()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{PublicKey: publicKey(private), PrivateKey: private[:]}, nil
+}
+
+// EncodePublicKey returns the textual form of a public key as used in the .recipients files.
+func EncodePublicKey(publicKey []byte) string {
+	return base64.StdEncoding.EncodeToString(publicKey)
+}
+
+// DecodePublicKey parses the textual form of a public key.
+func DecodePublicKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+
+	if err != nil || len(key) != X25519KeySize {
+		return nil, errors.New("invalid public key: " + s)
+	}
+
+	return key, nil
+}
+
+// WrapForRecipient encrypts the data key for the owner of the given public key. A fresh ephemeral key pair is
+// created for every wrap, its public part has to be stored next to the wrapped key.
+func WrapForRecipient(e Engine, dataKey []byte, recipient []byte, additionalData []byte) ([]byte, []byte, error) {
+	ephemeralPrivate, err := randomScalar()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ephemeral := publicKey(ephemeralPrivate)
+
+	wrapKey, err := recipientWrapKey(ephemeralPrivate[:], recipient, ephemeral, recipient)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := e.Encrypt(dataKey, wrapKey, additionalData)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ephemeral, wrapped, nil
+}
+
+// Unwrap decrypts a data key wrapped for this identity by WrapForRecipient.
+func (id *Identity) Unwrap(e Engine, ephemeral []byte, wrapped []byte, additionalData []byte) ([]byte, error) {
+	wrapKey, err := recipientWrapKey(id.PrivateKey, ephemeral, ephemeral, id.PublicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Decrypt(wrapped, wrapKey, additionalData)
+}
+
+// recipientWrapKey agrees on a shared secret with X25519 and derives the wrapping key from it with HKDF-SHA256.
+// Both public keys go into the salt, so the wrapping key is bound to this very pair.
+func recipientWrapKey(private []byte, public []byte, ephemeral []byte, recipient []byte) ([]byte, error) {
+	if len(private) != X25519KeySize || len(public) != X25519KeySize {
+		return nil, errors.New("invalid X25519 key size")
+	}
+
+	var scalar, point, shared [X25519KeySize]byte
+	copy(scalar[:], private)
+	copy(point[:], public)
+
+	curve25519.ScalarMult(&shared, &scalar, &point)
+
+	// a low order point given as public key results in an all zero secret
+	if subtle.ConstantTimeCompare(shared[:], make([]byte, X25519KeySize)) == 1 {
+		return nil, errors.New("invalid X25519 public key")
+	}
+
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	wrapKey := make([]byte, KeySize)
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared[:], salt, []byte(recipientWrapInfo)), wrapKey); err != nil {
+		return nil, err
+	}
+
+	return wrapKey, nil
+}
+
+func randomScalar() (*[X25519KeySize]byte, error) {
+	var scalar [X25519KeySize]byte
+
+	if _, err := io.ReadFull(rand.Reader, scalar[:]); err != nil {
+		return nil, err
+	}
+
+	return &scalar, nil
+}
+
+func publicKey(private *[X25519KeySize]byte) []byte {
+	var public [X25519KeySize]byte
+	curve25519.ScalarBaseMult(&public, private)
+	return public[:]
+}
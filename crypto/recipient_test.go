@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrapForRecipient(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	dataKey, _ := NewRandomKey()
+	ad := []byte("header")
+	e := NewEngine()
+
+	ephemeral, wrapped, err := WrapForRecipient(e, dataKey, alice.PublicKey, ad)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unwrapped, err := alice.Unwrap(e, ephemeral, wrapped, ad); err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatal(err)
+	}
+
+	if _, err := bob.Unwrap(e, ephemeral, wrapped, ad); err == nil {
+		t.Error("wrong identity could unwrap")
+	}
+
+	if _, err := alice.Unwrap(e, ephemeral, wrapped, []byte("other")); err == nil {
+		t.Error("additional data not authenticated")
+	}
+
+	if _, _, err := WrapForRecipient(e, dataKey, make([]byte, X25519KeySize), ad); err == nil {
+		t.Error("low order public key accepted")
+	}
+}
+
+func TestPublicKeyEncoding(t *testing.T) {
+	id, _ := NewIdentity()
+
+	if key, err := DecodePublicKey(EncodePublicKey(id.PublicKey)); err != nil || !bytes.Equal(key, id.PublicKey) {
+		t.Fail()
+	}
+
+	if _, err := DecodePublicKey("c2hvcnQ="); err == nil {
+		t.Fail()
+	}
+}
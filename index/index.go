@@ -0,0 +1,177 @@
+package index
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"loki/config"
+	"loki/crypto"
+	pb "loki/storage"
+	"loki/utils"
+)
+
+// additionalData binds the ciphertext to its purpose, a record could never be passed off as index.
+var additionalData = []byte("loki index")
+
+// Index maps the names of the records of a store with hidden names to the files they are stored in. The files
+// carry random names and live all side by side in the root of the store, so neither the names nor the directory
+// structure are visible on disk. The index itself is encrypted with the masterkey.
+type Index struct {
+	filename string
+	entries  map[string]string
+}
+
+// New creates an empty index to be stored at filename.
+func New(filename string) *Index {
+	return &Index{filename: filename, entries: make(map[string]string)}
+}
+
+// Load decrypts the index stored at filename with the given key.
+func Load(filename string, key crypto.Key) (*Index, error) {
+	data, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, errors.New("could not read index: " + filename)
+	}
+
+	serialized, err := key.Decrypt(crypto.NewEngine(), data, additionalData)
+
+	if err != nil {
+		return nil, errors.New("unable to decrypt index, password?")
+	}
+
+	ix := &pb.Index{}
+
+	if err := proto.Unmarshal(serialized, ix); err != nil {
+		return nil, errors.New("error unmarshaling index")
+	}
+
+	index := New(filename)
+
+	for name, file := range ix.Entries {
+		index.entries[name] = file
+	}
+
+	return index, nil
+}
+
+// Save encrypts the index with the given key and stores it.
+func (index *Index) Save(key crypto.Key) error {
+	if key == nil {
+		return errors.New("stores with hidden names need the masterpassword")
+	}
+
+	serialized, err := proto.Marshal(&pb.Index{Entries: index.entries})
+
+	if err != nil {
+		return err
+	}
+
+	data, err := key.Encrypt(crypto.NewEngine(), serialized, additionalData)
+
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFile(index.filename, data)
+}
+
+// Lookup returns the file the record with the given name is stored in, relative to the root of the store.
+func (index *Index) Lookup(name string) (string, bool) {
+	file, ok := index.entries[Clean(name)]
+	return file, ok
+}
+
+// Add creates a new entry with a fresh random file for the given name.
+func (index *Index) Add(name string) (string, error) {
+	name = Clean(name)
+
+	if len(name) == 0 {
+		return "", errors.New("empty name")
+	}
+
+	if _, ok := index.entries[name]; ok {
+		return "", errors.New("record already exists: " + name)
+	}
+
+	if index.IsDir(name) {
+		return "", errors.New("a directory with this name exists: " + name)
+	}
+
+	id := make([]byte, 16)
+
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+
+	file := hex.EncodeToString(id) + config.FileSuffix
+	index.entries[name] = file
+	return file, nil
+}
+
+// Remove deletes the entry with the given name and returns the file it was stored in.
+func (index *Index) Remove(name string) (string, bool) {
+	name = Clean(name)
+	file, ok := index.entries[name]
+
+	delete(index.entries, name)
+	return file, ok
+}
+
+// Rename gives the record stored under oldname the new name, the file stays the same.
+func (index *Index) Rename(oldname string, newname string) error {
+	oldname, newname = Clean(oldname), Clean(newname)
+	file, ok := index.entries[oldname]
+
+	if !ok {
+		return errors.New("record not found: " + oldname)
+	}
+
+	if _, ok := index.entries[newname]; ok {
+		return errors.New("record already exists: " + newname)
+	}
+
+	delete(index.entries, oldname)
+	index.entries[newname] = file
+	return nil
+}
+
+// IsDir returns true if there are records below the given name, i.e. it is used as a directory.
+func (index *Index) IsDir(name string) bool {
+	return len(index.Below(name)) > 0
+}
+
+// Below returns the sorted names of all records in the directory given with name and its subdirectories.
+// An empty name gives all records.
+func (index *Index) Below(name string) []string {
+	prefix := Clean(name)
+
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+
+	names := []string{}
+
+	for n := range index.entries {
+		if strings.HasPrefix(n, prefix) {
+			names = append(names, n)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Clean turns the name given by the user into the form kept in the index: slash separated, without leading
+// slashes and without the file suffix.
+func Clean(name string) string {
+	name = path.Clean("/" + strings.TrimSuffix(name, config.FileSuffix))
+	return strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,96 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"loki/crypto"
+)
+
+func TestAddLookupRename(t *testing.T) {
+	ix := New("unused")
+
+	file, err := ix.Add("/mail/work.loki")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f, ok := ix.Lookup("mail/work"); !ok || f != file {
+		t.Error("lookup failed")
+	}
+
+	if _, err := ix.Add("mail/work"); err == nil {
+		t.Error("name added twice")
+	}
+
+	if _, err := ix.Add("mail"); err == nil {
+		t.Error("directory used as name")
+	}
+
+	ix.Add("mail/private")
+	ix.Add("web")
+
+	if names := ix.Below("mail"); !reflect.DeepEqual(names, []string{"mail/private", "mail/work"}) {
+		t.Errorf("unexpected names: %v", names)
+	}
+
+	if err := ix.Rename("mail/work", "job/mail"); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, ok := ix.Lookup("job/mail"); !ok || f != file {
+		t.Error("rename lost the file")
+	}
+
+	if err := ix.Rename("web", "mail/private"); err == nil {
+		t.Error("rename overwrote a record")
+	}
+
+	if f, ok := ix.Remove("job/mail"); !ok || f != file || ix.IsDir("job") {
+		t.Error("remove failed")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki_index")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, ".index")
+	random, _ := crypto.NewRandomKey()
+	key := crypto.LocalKey(random)
+	ix := New(filename)
+	ix.Add("mail/work")
+
+	if err := ix.Save(key); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(filename, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded.entries, ix.entries) {
+		t.Error("entries differ")
+	}
+
+	other, _ := crypto.NewRandomKey()
+
+	if _, err := Load(filename, crypto.LocalKey(other)); err == nil {
+		t.Error("index decrypted with the wrong key")
+	}
+
+	if err := ix.Save(nil); err == nil {
+		t.Error("index saved without key")
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"github.com/fatih/color"
 	"loki/cmd"
 	"loki/config"
+	"loki/crypto"
 	"loki/log"
+	"loki/record"
 	"loki/subcommand"
+	"loki/tree"
 	"loki/utils"
 	"os"
 )
@@ -17,11 +20,11 @@ func main() {
 
 	// Register all commands
 	// Boolean: default command, hidden, modifying
-	commandList.Register([]string{"ls", "list"}, 0, "", true, cmd.List, "Lists the password store in a treelike fashion.", false, false)
+	commandList.Register([]string{"ls", "list"}, 0, "[--long] [--type kind] [dir]", true, cmd.List, "Lists the password store in a treelike fashion.", false, false)
 	commandList.Register([]string{"show"}, 1, "filename", false, cmd.Show, "Shows the contents of file.", false, false)
-	commandList.Register([]string{"insert", "add"}, 1, "filename", false, cmd.Insert, "Inserts new data into file.", false, true)
+	commandList.Register([]string{"insert", "add"}, 1, "[--type login|card|ssh|note|identity] filename", false, cmd.Insert, "Inserts new data into file.", false, true)
 	commandList.Register([]string{"import"}, 1, "keepass-filename", false, cmd.Import, "Imports a KeepassX CSV file.", false, true)
-	commandList.Register([]string{"init"}, 0, "[pathname]", false, cmd.Init, "Initialize a new password store.", false, true)
+	commandList.Register([]string{"init"}, 0, "[--keyfile path] [--hidden] [pathname]", false, cmd.Init, "Initialize a new password store.", false, true)
 	commandList.Register([]string{"login", "pw", "pass"}, 0, "", false, cmd.Login, "Authenticate against password store.", false, false)
 	commandList.Register([]string{"dump"}, 0, "", false, cmd.Dump, "Dumps all information.", true, false)
 	commandList.Register([]string{"search", "grep", "find"}, 1, "<querystring>", false, cmd.Search, "Searches for given string in all fields and recordnames.", false, false)
@@ -30,8 +33,20 @@ func main() {
 	commandList.Register([]string{"copy", "cp"}, 2, "<file|dir>", false, cmd.Copy, "Copy a Record or a subtree.", false, true)
 	commandList.Register([]string{"move", "mv"}, 2, "<file|dir>", false, cmd.Move, "Moves a Record or a subtree.", false, true)
 	commandList.Register([]string{"shutdown", "stop"}, 0, "", false, cmd.Stop, "Stops the Agent.", false, false)
+	commandList.Register([]string{"agent"}, 1, "status|lock|unlock", false, cmd.Agent, "Shows the state of the agent, wipes or loads its keys.", false, false)
 	commandList.Register([]string{"change"}, 0, "", false, cmd.ChangeMasterkey, "Changes the masterpassword in all files.", false, true)
 	commandList.Register([]string{"diff"}, 2, "", false, cmd.Diff, "Diffs two files.", true, false)
+	commandList.Register([]string{"upgrade"}, 0, "[--dry-run]", false, cmd.Upgrade, "Rewrites all records in the newest datafile format.", false, true)
+	commandList.Register([]string{"recipients"}, 1, "identity|list [dir]|add <dir> <key> [name]|remove <dir> <key|name>", false, cmd.Recipients, "Manages the team members a subtree is encrypted for.", false, true)
+	commandList.Register([]string{"otp"}, 1, "[--import] <record> [otpauth-uri]", false, cmd.Otp, "Shows the one-time password of a record.", false, true)
+	commandList.Register([]string{"expiring"}, 0, "[days]", false, cmd.Expiring, "Lists the records expiring within the given days (30).", false, false)
+	commandList.Register([]string{"history"}, 1, "<record>", false, cmd.History, "Lists the earlier passwords of a record.", false, false)
+	commandList.Register([]string{"restore-password"}, 2, "<record> <number>", false, cmd.RestorePassword, "Makes an earlier password of a record the current one.", false, true)
+	commandList.Register([]string{"attach"}, 2, "[--name name] [--type mime-type] <record> <file>", false, cmd.Attach, "Stores a file inside a record.", false, true)
+	commandList.Register([]string{"detach"}, 2, "<record> <name>", false, cmd.Detach, "Removes an attachment from a record.", false, true)
+	commandList.Register([]string{"extract"}, 2, "<record> <name> [-o file]", false, cmd.Extract, "Writes an attachment of a record to a file or stdout.", false, false)
+	commandList.Register([]string{"names"}, 0, "", false, cmd.Names, "Lists the names of all records, used by the bash completion.", true, false)
+	commandList.Register([]string{"kdf"}, 1, "calibrate [-apply] [-memory MiB] [500ms]", false, cmd.Kdf, "Calibrates the key derivation costs to a target unlock time.", false, true)
 
 	commandList.Register([]string{"help"}, 0, "", false, helpSubcommand, "Shows general help information.", false, false)
 	// this will be transformed to a info command
@@ -49,6 +64,61 @@ func main() {
 
 	cfg.Binpath = utils.GetBinaryPath()
 
+	cipher, err := crypto.CipherFromName(cfg.Cipher)
+
+	if err != nil {
+		log.Fatal("Invalid configuration: %v", err)
+		utils.ExitSystemFailure()
+	}
+
+	padding, err := record.PaddingFromName(cfg.Padding)
+
+	if err != nil {
+		log.Fatal("Invalid configuration: %v", err)
+		utils.ExitSystemFailure()
+	}
+
+	historyLimit, err := record.ParseHistoryLimit(cfg.History)
+
+	if err != nil {
+		log.Fatal("Invalid configuration: %v", err)
+		utils.ExitSystemFailure()
+	}
+
+	idleTimeout, err := utils.ParseAgentTimeout(cfg.IdleTimeout, config.DefaultIdleTimeout)
+
+	if err != nil {
+		log.Fatal("Invalid configuration: %v", err)
+		utils.ExitSystemFailure()
+	}
+
+	maxLifetime, err := utils.ParseAgentTimeout(cfg.MaxLifetime, config.DefaultMaxLifetime)
+
+	if err != nil {
+		log.Fatal("Invalid configuration: %v", err)
+		utils.ExitSystemFailure()
+	}
+
+	confirmGrace, err := utils.ParseAgentTimeout(cfg.ConfirmGrace, 0)
+
+	if err != nil {
+		log.Fatal("Invalid configuration: %v", err)
+		utils.ExitSystemFailure()
+	}
+
+	record.SetCipher(cipher)
+	record.SetHistoryLimit(historyLimit)
+	record.SetPadding(padding)
+	record.SetIdentityLoader(utils.IdentityLoader(cfg))
+	utils.SetAgentTimeouts(idleTimeout, maxLifetime)
+	utils.SetAgentCallerCheck(cfg.CheckCaller)
+	utils.SetAgentSealed(cfg.SealedAgent)
+	utils.SetAgentConfirm(cfg.ConfirmAgent, cfg.ConfirmHelper, confirmGrace)
+	utils.SetAgentPaths(cfg.GetSocketfilePath(), cfg.GetAgentLogfilePath())
+	utils.SetKeyProbe(func(key crypto.Key) (bool, error) {
+		return tree.ProbeKey(sysdir, key)
+	})
+
 	log.Info("%s, data: %s\n", cfg.GreetingString(), sysdir)
 
 	// display help in any case, wether we have a decent setup or not.
@@ -83,6 +153,8 @@ func main() {
 		}
 	} else {
 		cfg.Generation = masterfile.Generation
+		cfg.HiddenNames = masterfile.HiddenNames
+		cfg.StoreID = masterfile.StoreId // empty for stores older than store IDs, until modified by a command below
 	}
 
 	if err == nil {
@@ -127,6 +199,12 @@ func dispatchToHandler(cfg config.Configuration, subcommand string, arg ...strin
 		log.Debug("Running git command: %v", gitAdd)
 		utils.GitCommand(gitAdd)
 
+		// commands like upgrade --dry-run might not have changed anything
+		if !utils.GitHasStagedChanges() {
+			log.Debug("Nothing changed, no commit.")
+			return err
+		}
+
 		gitParams := []string{"commit", "-a", "-m", "'Loki commit triggered by command: " + cmd.Aliases[0] + "'"}
 		log.Debug("Running git command: %v", gitParams)
 		utils.GitCommand(gitParams)
@@ -0,0 +1,268 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"loki/crypto"
+	pb "loki/storage"
+	"loki/utils"
+)
+
+// maxEnvelopeSize limits the memory allocated for the envelope of a format version 4 or 5 file.
+const maxEnvelopeSize uint32 = 64 * 1024
+
+// formatParser reads the rest of the header and the payload of a lokifile whose first 16 bytes (given in base)
+// are already read and parsed into hdr. It returns the decrypted and verified record.
+type formatParser func(f *os.File, base []byte, hdr *DataFileHeader, key crypto.Key) (*pb.Record, error)
+
+var formatParsers = map[uint32]formatParser{
+	LokiFormatVersion1: parseFormatV1,
+	LokiFormatVersion2: parseFormatV2,
+	LokiFormatVersion3: parseFormatV3,
+	LokiFormatVersion4: parseFormatV4,
+	LokiFormatVersion5: parseFormatV5,
+}
+
+func parseFormatV1(f *os.File, base []byte, hdr *DataFileHeader, key crypto.Key) (*pb.Record, error) {
+	hdr.PayloadMD5 = make([]byte, LokiHeaderSizeV1-LokiBaseHeaderSize)
+
+	if _, err := io.ReadFull(f, hdr.PayloadMD5); err != nil {
+		return &pb.Record{}, fmt.Errorf("header corrupted: %v", err)
+	}
+
+	payload, err := readPayload(f, LokiHeaderSizeV1, hdr.PayloadSize)
+
+	if err != nil {
+		return &pb.Record{}, err
+	}
+
+	rec, err := decryptPayload(crypto.NewEngine(), payload, key, nil)
+
+	if err != nil {
+		return rec, err
+	}
+
+	if !crypto.VerifyMD5(payload, hdr.PayloadMD5) {
+		return rec, errors.New("md5 checksum incorrect")
+	}
+
+	if rec.Md5 != ComputeInnerMd5(rec) {
+		return rec, errors.New("inner MD5 checksum incorrect")
+	}
+
+	return rec, nil
+}
+
+func parseFormatV2(f *os.File, base []byte, hdr *DataFileHeader, key crypto.Key) (*pb.Record, error) {
+	payload, err := readPayload(f, LokiHeaderSizeV2, hdr.PayloadSize)
+
+	if err != nil {
+		return &pb.Record{}, err
+	}
+
+	// the header is authenticated as additional data
+	return decryptPayload(crypto.NewEngine(), payload, key, base)
+}
+
+func parseFormatV3(f *os.File, base []byte, hdr *DataFileHeader, key crypto.Key) (*pb.Record, error) {
+	cipherField := make([]byte, LokiHeaderSizeV3-LokiBaseHeaderSize)
+
+	if _, err := io.ReadFull(f, cipherField); err != nil {
+		return &pb.Record{}, fmt.Errorf("header corrupted: %v", err)
+	}
+
+	hdr.Cipher = crypto.Cipher(binary.BigEndian.Uint32(cipherField))
+
+	e, err := crypto.NewEngineForCipher(hdr.Cipher)
+
+	if err != nil {
+		return &pb.Record{}, err
+	}
+
+	payload, err := readPayload(f, LokiHeaderSizeV3, hdr.PayloadSize)
+
+	if err != nil {
+		return &pb.Record{}, err
+	}
+
+	// the full header is authenticated as additional data
+	return decryptPayload(e, payload, key, append(base, cipherField...))
+}
+
+func parseFormatV4(f *os.File, base []byte, hdr *DataFileHeader, kek crypto.Key) (*pb.Record, error) {
+	envelope, payload, err := readEnvelopedRecord(f, hdr)
+
+	if err != nil {
+		return &pb.Record{}, err
+	}
+
+	e, dataKey, err := unwrapDataKey(hdr, envelope, kek)
+
+	if err != nil {
+		return &pb.Record{}, err
+	}
+
+	// the data key is unique to this file and bound to the header by the key wrap
+	return decryptPayload(e, payload, crypto.LocalKey(dataKey), nil)
+}
+
+func parseFormatV5(f *os.File, base []byte, hdr *DataFileHeader, kek crypto.Key) (*pb.Record, error) {
+	envelope, payload, err := readEnvelopedRecord(f, hdr)
+
+	if err != nil {
+		return &pb.Record{}, err
+	}
+
+	e, dataKey, err := unwrapDataKey(hdr, envelope, kek)
+
+	if err != nil {
+		return &pb.Record{}, err
+	}
+
+	return decryptPaddedPayload(e, payload, crypto.LocalKey(dataKey), nil, true)
+}
+
+// readEnvelopedRecord reads the rest of the header, the envelope and the still encrypted payload of a
+// format version 4 or 5 file.
+func readEnvelopedRecord(f *os.File, hdr *DataFileHeader) (*pb.Envelope, []byte, error) {
+	fields := make([]byte, LokiHeaderSizeV4-LokiBaseHeaderSize)
+
+	if _, err := io.ReadFull(f, fields); err != nil {
+		return nil, nil, fmt.Errorf("header corrupted: %v", err)
+	}
+
+	hdr.Cipher = crypto.Cipher(binary.BigEndian.Uint32(fields[0:4]))
+	hdr.EnvelopeSize = binary.BigEndian.Uint32(fields[4:8])
+
+	if hdr.EnvelopeSize > maxEnvelopeSize {
+		return nil, nil, fmt.Errorf("envelope too large: %d", hdr.EnvelopeSize)
+	}
+
+	data := make([]byte, hdr.EnvelopeSize)
+
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, nil, fmt.Errorf("envelope corrupted: %v", err)
+	}
+
+	envelope := &pb.Envelope{}
+
+	if err := proto.Unmarshal(data, envelope); err != nil {
+		return nil, nil, errors.New("error unmarshaling envelope")
+	}
+
+	payload, err := readPayload(f, LokiHeaderSizeV4+int(hdr.EnvelopeSize), hdr.PayloadSize)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return envelope, payload, nil
+}
+
+// unwrapDataKey decrypts the data key of the envelope with the key-encryption key and returns it
+// together with the engine to decrypt the payload with. If this fails the users identity is tried
+// on the recipients of the envelope.
+func unwrapDataKey(hdr *DataFileHeader, envelope *pb.Envelope, kek crypto.Key) (crypto.Engine, []byte, error) {
+	e, err := crypto.NewEngineForCipher(hdr.Cipher)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	additionalData := keyWrapData(hdr.FormatVersion, hdr.Generation, hdr.PayloadSize, hdr.Cipher)
+
+	if kek != nil && len(envelope.WrappedKey) > 0 {
+		if dataKey, err := kek.Decrypt(e, envelope.WrappedKey, additionalData); err == nil {
+			return e, dataKey, nil
+		}
+	}
+
+	if len(envelope.Recipients) > 0 {
+		if id := loadIdentity(); id != nil {
+			for _, r := range envelope.Recipients {
+				if !bytes.Equal(r.PublicKey, id.PublicKey) {
+					continue
+				}
+
+				if dataKey, err := id.Unwrap(e, r.EphemeralKey, r.WrappedKey, additionalData); err == nil {
+					return e, dataKey, nil
+				}
+			}
+		}
+	}
+
+	return nil, nil, errors.New("unable to decrypt, password?")
+}
+
+// wrapDataKey creates the envelope for the record given with path. The data key is wrapped with the
+// key-encryption key and for every recipient listed in the .recipients file responsible for path.
+// Without a key-encryption key the already wrapped key given in keptKey is used, if any. Records
+// without any masterkey wrap must have recipients.
+func wrapDataKey(path string, additionalData []byte, kek crypto.Key, keptKey []byte, e crypto.Engine, dataKey []byte) (*pb.Envelope, error) {
+	recipients, err := FindRecipients(filepath.Dir(path))
+
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &pb.Envelope{WrappedKey: keptKey}
+
+	if kek != nil {
+		if envelope.WrappedKey, err = kek.Encrypt(e, dataKey, additionalData); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(envelope.WrappedKey) == 0 && len(recipients) == 0 {
+		return nil, errors.New("records outside of a recipients directory need the masterpassword")
+	}
+
+	for _, r := range recipients {
+		ephemeral, wrapped, err := crypto.WrapForRecipient(e, dataKey, r.PublicKey, additionalData)
+
+		if err != nil {
+			return nil, fmt.Errorf("recipient %s: %v", r.Name, err)
+		}
+
+		envelope.Recipients = append(envelope.Recipients, &pb.RecipientKey{
+			PublicKey:    r.PublicKey,
+			EphemeralKey: ephemeral,
+			WrappedKey:   wrapped,
+		})
+	}
+
+	return envelope, nil
+}
+
+// writeEnvelopedRecord stores the envelope and the encrypted payload in the format version 4 and 5 layout. The header
+// given has to be the one authenticated by the key wraps of the envelope.
+func writeEnvelopedRecord(path string, hdr []byte, envelope *pb.Envelope, payload []byte) error {
+	serialized, err := proto.Marshal(envelope)
+
+	if err != nil {
+		return err
+	}
+
+	data := appendUint32(append([]byte{}, hdr...), uint32(len(serialized)))
+	data = append(data, serialized...)
+	return utils.WriteFile(path, append(data, payload...))
+}
+
+// keyWrapData returns the part of the header which is authenticated by the key wrap: Magic, version,
+// generation, payload size and cipher.
+func keyWrapData(version uint32, generation uint32, payloadSize uint32, c crypto.Cipher) []byte {
+	return appendUint32(createHeader(version, generation, payloadSize), uint32(c))
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	field := make([]byte, 4)
+	binary.BigEndian.PutUint32(field, value)
+	return append(data, field...)
+}
@@ -0,0 +1,111 @@
+package record
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// paddingMarker starts the padding as in ISO/IEC 7816-4, all following padding bytes are zero.
+const paddingMarker byte = 0x80
+
+// minPowerOfTwoSize is the smallest bucket of the power of two padding, most records fit into it.
+const minPowerOfTwoSize = 256
+
+// maxPaddingBlockSize limits the block size given in the configfile.
+const maxPaddingBlockSize = 64 * 1024
+
+// Padding describes the size buckets the serialized record is padded to before it gets encrypted. The payload
+// size in the header then only tells the bucket instead of the exact length of passwords and notes.
+type Padding struct {
+	BlockSize  int  // the padded size is a multiple of BlockSize
+	PowerOfTwo bool // the padded size is a power of two, at least minPowerOfTwoSize
+}
+
+// NoPadding only adds the marker byte.
+var NoPadding = Padding{BlockSize: 1}
+
+// padding is used for all new writes
+var padding = NoPadding
+
+// SetPadding selects the padding used by WriteRecord. Reading removes any padding.
+func SetPadding(p Padding) {
+	padding = p
+}
+
+// PaddingFromName returns the padding given in the configfile: "none", "pow2" or a block size in bytes. An
+// empty name gives no padding.
+func PaddingFromName(name string) (Padding, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return NoPadding, nil
+	case "pow2":
+		return Padding{PowerOfTwo: true}, nil
+	}
+
+	size, err := strconv.Atoi(name)
+
+	if err != nil || size < 1 || size > maxPaddingBlockSize {
+		return Padding{}, errors.New("unknown padding: " + name)
+	}
+
+	return Padding{BlockSize: size}, nil
+}
+
+// String returns the name of the padding as used in the configfile.
+func (p Padding) String() string {
+	if p.PowerOfTwo {
+		return "pow2"
+	}
+
+	if p.BlockSize <= 1 {
+		return "none"
+	}
+
+	return strconv.Itoa(p.BlockSize)
+}
+
+// paddedSize returns the size data of the given length is padded to. There is always room for the marker.
+func (p Padding) paddedSize(length int) int {
+	length++
+
+	if p.PowerOfTwo {
+		size := minPowerOfTwoSize
+
+		for size < length {
+			size *= 2
+		}
+
+		return size
+	}
+
+	if p.BlockSize <= 1 {
+		return length
+	}
+
+	return (length + p.BlockSize - 1) / p.BlockSize * p.BlockSize
+}
+
+// pad appends the marker and as many zero bytes as needed to reach the padded size.
+func (p Padding) pad(data []byte) []byte {
+	padded := make([]byte, p.paddedSize(len(data)))
+	copy(padded, data)
+	padded[len(data)] = paddingMarker
+	return padded
+}
+
+// unpad removes the padding added by pad. The padding is part of the authenticated plaintext, so it could
+// only be malformed by a broken writer.
+func unpad(data []byte) ([]byte, error) {
+	i := len(data) - 1
+
+	for i >= 0 && data[i] == 0 {
+		i--
+	}
+
+	if i < 0 || data[i] != paddingMarker {
+		return nil, errors.New("invalid padding")
+	}
+
+	return data[:i], nil
+}
@@ -0,0 +1,87 @@
+package record
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "loki/storage"
+)
+
+func TestPaddingFromName(t *testing.T) {
+	for name, expected := range map[string]Padding{
+		"":     NoPadding,
+		"none": NoPadding,
+		"POW2": {PowerOfTwo: true},
+		"128":  {BlockSize: 128},
+	} {
+		if p, err := PaddingFromName(name); err != nil || p != expected {
+			t.Errorf("%s: %v %v", name, p, err)
+		}
+	}
+
+	for _, name := range []string{"0", "-1", "huge", "1000000"} {
+		if _, err := PaddingFromName(name); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
+
+func TestPadUnpad(t *testing.T) {
+	for _, p := range []Padding{NoPadding, {PowerOfTwo: true}, {BlockSize: 64}} {
+		for _, length := range []int{0, 1, 63, 64, 255, 256, 1000} {
+			data := bytes.Repeat([]byte{0}, length)
+			padded := p.pad(data)
+
+			if p.PowerOfTwo && (len(padded) < minPowerOfTwoSize || len(padded)&(len(padded)-1) != 0) {
+				t.Errorf("%s: %d padded to %d", p, length, len(padded))
+			}
+
+			if p.BlockSize > 1 && len(padded)%p.BlockSize != 0 {
+				t.Errorf("%s: %d padded to %d", p, length, len(padded))
+			}
+
+			if unpadded, err := unpad(padded); err != nil || !bytes.Equal(unpadded, data) {
+				t.Errorf("%s: %d not restored: %v", p, length, err)
+			}
+		}
+	}
+
+	if _, err := unpad([]byte{1, 2, 0, 0}); err == nil {
+		t.Error("missing marker accepted")
+	}
+
+	if _, err := unpad([]byte{}); err == nil {
+		t.Error("empty data accepted")
+	}
+}
+
+func TestWritePadded(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+	defer SetPadding(NoPadding)
+
+	SetPadding(Padding{PowerOfTwo: true})
+	sizes := map[uint32]bool{}
+
+	for _, password := range []string{"a", strings.Repeat("a", 100)} {
+		if err := WriteRecord(filename, 7, key, &pb.Record{Password: password}); err != nil {
+			t.Fatal(err)
+		}
+
+		rec, hdr, err := LoadRecord(filename, key)
+
+		if err != nil || rec.Password != password {
+			t.Fatal(err)
+		}
+
+		sizes[hdr.PayloadSize] = true
+	}
+
+	if len(sizes) != 1 {
+		t.Errorf("payload sizes differ: %v", sizes)
+	}
+}
@@ -0,0 +1,138 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"loki/config"
+	"loki/crypto"
+	"loki/utils"
+)
+
+// Recipient is one entry of a .recipients file: the public key of a team member and an optional name.
+type Recipient struct {
+	PublicKey []byte
+	Name      string
+}
+
+// IdentityLoader returns the identity of the user to unwrap data keys of team records with. It is only
+// called when a record could not be opened with the masterkey.
+type IdentityLoader func() (*crypto.Identity, error)
+
+var identityLoader IdentityLoader
+
+// SetIdentityLoader installs the function providing the users identity.
+func SetIdentityLoader(loader IdentityLoader) {
+	identityLoader = loader
+}
+
+// LoadRecipients reads the .recipients file of the directory given with dir. Every line holds a base64 encoded
+// X25519 public key followed by an optional name, empty lines and lines starting with # are ignored.
+// A missing file gives an empty list.
+func LoadRecipients(dir string) ([]Recipient, error) {
+	f, err := os.Open(filepath.Join(dir, config.RecipientsFile))
+
+	if os.IsNotExist(err) {
+		return []Recipient{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	recipients := []Recipient{}
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		key, err := crypto.DecodePublicKey(fields[0])
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+
+		recipient := Recipient{PublicKey: key}
+
+		if len(fields) > 1 {
+			recipient.Name = strings.TrimSpace(fields[1])
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, scanner.Err()
+}
+
+// StoreRecipients writes the .recipients file of the directory given with dir. An empty list removes the file.
+func StoreRecipients(dir string, recipients []Recipient) error {
+	filename := filepath.Join(dir, config.RecipientsFile)
+
+	if len(recipients) == 0 {
+		return os.Remove(filename)
+	}
+
+	var buffer bytes.Buffer
+
+	for _, r := range recipients {
+		buffer.WriteString(strings.TrimSpace(crypto.EncodePublicKey(r.PublicKey) + " " + r.Name))
+		buffer.WriteString("\n")
+	}
+
+	return utils.WriteFile(filename, buffer.Bytes())
+}
+
+// FindRecipients returns the recipients the records in the directory given with dir are encrypted for. These are
+// given by the .recipients file in the nearest directory up to the root of the store, which is the directory
+// holding the masterfile. An empty list means the records are protected by the masterkey only.
+func FindRecipients(dir string) ([]Recipient, error) {
+	dir, err := filepath.Abs(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if _, err := os.Stat(filepath.Join(dir, config.RecipientsFile)); err == nil {
+			return LoadRecipients(dir)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, config.MasterFilename)); err == nil {
+			return []Recipient{}, nil
+		}
+
+		parent := filepath.Dir(dir)
+
+		if parent == dir {
+			return []Recipient{}, nil
+		}
+
+		dir = parent
+	}
+}
+
+// loadIdentity returns the users identity or nil if there is none.
+func loadIdentity() *crypto.Identity {
+	if identityLoader == nil {
+		return nil
+	}
+
+	id, err := identityLoader()
+
+	if err != nil {
+		return nil
+	}
+
+	return id
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"loki/config"
@@ -15,18 +18,54 @@ import (
 	"loki/utils"
 )
 
-// This is the basic binary header of every loki-file
+// This is the basic binary header of every loki-file. All format versions share the
+// first 16 bytes:
 //
 // Magic      : 4c 4f 4b 49     :  4 : "LOKI" Magic Header
-// Version    : 00 00 00 01     :  4 : v1 - Protocol/Format version
+// Version    : 00 00 00 02     :  4 : Protocol/Format version
 // Generation : 00 00 00 17     :  4 : Generation number of Masterpassword
 // Size       : 00 00 00 00     :  4 : Size of encrypted payload
-// MD5 Hash   : 16 Bytes        : 16 : md5sum of encrypted payload
 //
 // Data       : .........       : Variable-sized encrypted payload
+//
+// Version 1 adds the md5sum of the encrypted payload (16 bytes) to the header. Version 2
+// drops it and authenticates the header by passing it as additional data to AES-GCM instead.
+// Version 3 adds the cipher the payload is encrypted with:
+//
+// Cipher     : 00 00 00 01     :  4 : 1 - AES-256-GCM, 2 - XChaCha20-Poly1305
+//
+// The whole header (20 bytes) is authenticated as additional data. Version 4 encrypts the payload
+// with a random data key per file. The data key is wrapped by the key-encryption key (the masterkey)
+// and stored in an envelope following the header:
+//
+// Envelope   : 00 00 00 3e     :  4 : Size of the envelope
+// Envelope   : .........       : Variable-sized protobuf, contains the wrapped data key
+//
+// The key wrap authenticates the first 20 bytes of the header. Changing the masterkey only
+// re-wraps the data key, the encrypted payload stays untouched. Version 5 keeps this layout but pads
+// the serialized record before encryption (ISO/IEC 7816-4: 0x80 followed by zero bytes), so the
+// payload size only reveals the size bucket.
 const (
-	LokiFormatVersion uint32 = 1
-	LokiHeaderSize    int    = 32
+	LokiFormatVersion1 uint32 = 1
+	LokiFormatVersion2 uint32 = 2
+	LokiFormatVersion3 uint32 = 3
+	LokiFormatVersion4 uint32 = 4
+	LokiFormatVersion5 uint32 = 5
+
+	// LokiFormatVersion is the format version written by WriteRecord.
+	LokiFormatVersion = LokiFormatVersion5
+
+	LokiBaseHeaderSize int = 16
+	LokiHeaderSizeV1   int = 32
+	LokiHeaderSizeV2   int = 16
+	LokiHeaderSizeV3   int = 20
+	LokiHeaderSizeV4   int = 24 // without the envelope, the same for version 5
+
+	// MaxRecordSize limits the size of the serialized record including attachments and padding.
+	MaxRecordSize = 16 * 1024 * 1024
+
+	// maxPayloadSize limits the encrypted payload read from a file, the ciphers add 40 bytes at most for nonce and tag.
+	maxPayloadSize uint32 = MaxRecordSize + 64
 
 	MagicValue1 byte = 0x4c
 	MagicValue2 byte = 0x4f
@@ -39,7 +78,9 @@ type DataFileHeader struct {
 	FormatVersion uint32
 	Generation    uint32
 	PayloadSize   uint32
-	PayloadMD5    []byte
+	PayloadMD5    []byte        // format version 1 only
+	Cipher        crypto.Cipher // always AES-256-GCM before format version 3
+	EnvelopeSize  uint32        // format version 4 and later
 }
 
 // Print prints the DataFileHeader prefixed with a number of spaces provided by the column parameter.
@@ -47,113 +88,371 @@ func (hdr *DataFileHeader) Print(column int) {
 	log.Debug("%*sFormat version : %d", column, "", hdr.FormatVersion)
 	log.Debug("%*sGeneration     : %d", column, "", hdr.Generation)
 	log.Debug("%*sPayload Size   : %d", column, "", hdr.PayloadSize)
-	log.Debug("%*sPayload MD5    : %s", column, "", utils.Hexdump(hdr.PayloadMD5))
+	log.Debug("%*sCipher         : %s", column, "", hdr.Cipher)
+
+	if len(hdr.PayloadMD5) > 0 {
+		log.Debug("%*sPayload MD5    : %s", column, "", utils.Hexdump(hdr.PayloadMD5))
+	}
+
+	if hdr.EnvelopeSize > 0 {
+		log.Debug("%*sEnvelope Size  : %d", column, "", hdr.EnvelopeSize)
+	}
+}
+
+// timeNow gives the time records are stamped with, it is replaced by tests.
+var timeNow = time.Now
+
+// DefaultHistoryLimit is the number of earlier passwords kept if nothing else is configured.
+const DefaultHistoryLimit = 10
+
+// historyLimit caps the password history of all records written
+var historyLimit = DefaultHistoryLimit
+
+// SetHistoryLimit sets the number of earlier passwords kept by WriteRecord, 0 drops the history.
+func SetHistoryLimit(limit int) {
+	historyLimit = limit
 }
 
+// ParseHistoryLimit returns the history limit given in the configfile. An empty value gives DefaultHistoryLimit.
+func ParseHistoryLimit(value string) (int, error) {
+	if len(value) == 0 {
+		return DefaultHistoryLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+
+	if err != nil || limit < 0 {
+		return 0, errors.New("invalid history limit: " + value)
+	}
+
+	return limit, nil
+}
+
+// engine is used for all new writes
 var engine = crypto.NewEngine()
 
+// SetCipher selects the cipher used by WriteRecord. Reading always uses the cipher given in the header.
+func SetCipher(c crypto.Cipher) error {
+	e, err := crypto.NewEngineForCipher(c)
+
+	if err != nil {
+		return err
+	}
+
+	engine = e
+	return nil
+}
+
 // ComputeInnerMd5 returns a hex-encoded string of the md5 hash of all fields for the provided record.
-func ComputeInnerMd5(rec pb.Record) string {
-	return utils.Hexdump(crypto.GetStringMD5(rec.Title + rec.Account + rec.Password + strings.Join(rec.Tags, ", ") + rec.Url + rec.Notes))
+// This is only used by format version 1. Custom fields and the otpauth URI are hashed after the fixed ones,
+// so the hash of records without them is unchanged.
+func ComputeInnerMd5(rec *pb.Record) string {
+	text := rec.Title + rec.Account + rec.Password + strings.Join(rec.Tags, ", ") + rec.Url + rec.Notes
+
+	for _, field := range rec.Fields {
+		text += fmt.Sprintf("%s%s%t", field.Name, field.Value, field.Concealed)
+	}
+
+	text += rec.Otpauth
+
+	for _, attachment := range rec.Attachments {
+		text += attachment.Name + attachment.MimeType + string(attachment.Data)
+	}
+
+	// logins keep their checksum, other types add their type and fields
+	if rec.Type != pb.RecordType_LOGIN {
+		text += rec.Type.Name() + rec.GetSshKey().GetPrivateKey()
+
+		for _, field := range rec.TypedFields() {
+			text += *field.Value
+		}
+	}
+
+	return utils.Hexdump(crypto.GetStringMD5(text))
 }
 
-// WriteRecord saves the given record using the given key to the location given with path.
-func WriteRecord(path string, generation uint32, key []byte, rec pb.Record) error {
-	// Adding Magic and inner-payload md5
+// WriteRecord saves the given record to the location given with path and updates its timestamps: the modification
+// time is always set, the creation time for new records and the password change time whenever the password differs
+// from the one of the record stored at path so far. The replaced password is kept in the history of the record.
+// The record stored at path has to be an earlier version of the same record, new records use WriteNewRecord.
+func WriteRecord(path string, generation uint32, kek crypto.Key, rec *pb.Record) error {
+	now := timeNow().Unix()
+
+	if old, _, err := LoadRecord(path, kek); err == nil {
+		if old.Password != rec.Password {
+			rec.PasswordChanged = now
+
+			if len(old.Password) > 0 {
+				entry := &pb.HistoryEntry{Password: old.Password, Changed: old.PasswordChanged, Replaced: now}
+				rec.History = append([]*pb.HistoryEntry{entry}, rec.History...)
+			}
+		}
+	} else if rec.PasswordChanged == 0 {
+		rec.PasswordChanged = now
+	}
+
+	return writeStamped(path, generation, kek, rec, now)
+}
+
+// WriteNewRecord saves the given record like WriteRecord, but as a new record. A record stored at path so far is
+// replaced without its passwords going into the history of the new one.
+func WriteNewRecord(path string, generation uint32, kek crypto.Key, rec *pb.Record) error {
+	now := timeNow().Unix()
+
+	if rec.PasswordChanged == 0 {
+		rec.PasswordChanged = now
+	}
+
+	return writeStamped(path, generation, kek, rec, now)
+}
+
+// writeStamped sets the creation time if missing and the modification time, trims the history and saves the record.
+func writeStamped(path string, generation uint32, kek crypto.Key, rec *pb.Record, now int64) error {
+	if rec.Created == 0 {
+		rec.Created = now
+	}
+
+	rec.Modified = now
+
+	if len(rec.History) > historyLimit {
+		rec.History = rec.History[:historyLimit]
+	}
+
+	return RewriteRecord(path, generation, kek, rec)
+}
+
+// RewriteRecord saves the given record like WriteRecord but keeps its timestamps, the content is not considered
+// changed. This is used when only the format or the key changes. The record is always written using the newest
+// format version: the payload is padded as selected with SetPadding and encrypted with a fresh random data key
+// which is wrapped by the given key-encryption key.
+func RewriteRecord(path string, generation uint32, kek crypto.Key, rec *pb.Record) error {
+	// Adding Magic, the integrity is guaranteed by the cipher
 	rec.Magic = config.InnerMagic
-	rec.Md5 = ComputeInnerMd5(rec)
+	rec.Md5 = ""
+
+	serialized, err := proto.Marshal(rec)
+
+	if err != nil {
+		return err
+	}
+
+	padded := padding.pad(serialized)
 
-	serialized, err := proto.Marshal(&rec)
+	// the limit holds for the padded record, which is all a reader has to allocate
+	if len(padded) > MaxRecordSize {
+		return fmt.Errorf("record too large: %d bytes padded, the limit is %d bytes", len(padded), MaxRecordSize)
+	}
+
+	dataKey, err := crypto.NewRandomKey()
 
 	if err != nil {
 		return err
 	}
 
-	encryptedPayload, err := engine.Encrypt(serialized, key)
+	payload, err := engine.Encrypt(padded, dataKey, nil)
 
 	if err != nil {
 		return err
 	}
 
-	hdr := createHeaderForPayload(encryptedPayload, generation)
+	hdr := keyWrapData(LokiFormatVersion, generation, uint32(len(payload)), engine.Cipher())
+	envelope, err := wrapDataKey(path, hdr, kek, nil, engine, dataKey)
+
+	if err != nil {
+		return err
+	}
 
-	return utils.WriteFile(path, append(hdr[:], encryptedPayload[:]...))
+	return writeEnvelopedRecord(path, hdr, envelope, payload)
 }
 
-func createHeaderForPayload(payload []byte, generation uint32) []byte {
-	header := make([]byte, LokiHeaderSize-16)
+// ChangeKey re-wraps the data key of the record given with path with the new key-encryption key and for the
+// recipients currently responsible for path, and stores it using the given generation. The encrypted payload
+// stays untouched. Without a new key-encryption key the existing masterkey wrap is kept, as long as the
+// generation does not change. The format version is kept, records in formats without an envelope are
+// decrypted and written in the newest format.
+func ChangeKey(path string, generation uint32, oldkek crypto.Key, newkek crypto.Key) error {
+	f, _, hdr, err := openRecordfile(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if hdr.FormatVersion < LokiFormatVersion4 {
+		rec, _, err := LoadRecord(path, oldkek)
+
+		if err != nil {
+			return err
+		}
+
+		return RewriteRecord(path, generation, newkek, rec)
+	}
+
+	envelope, payload, err := readEnvelopedRecord(f, &hdr)
+
+	if err != nil {
+		return err
+	}
+
+	e, dataKey, err := unwrapDataKey(&hdr, envelope, oldkek)
+
+	if err != nil {
+		return err
+	}
+
+	var keptKey []byte
+
+	// the masterkey wrap authenticates the generation, it could only be kept without a change
+	if generation == hdr.Generation {
+		keptKey = envelope.WrappedKey
+	}
+
+	newHdr := keyWrapData(hdr.FormatVersion, generation, hdr.PayloadSize, hdr.Cipher)
+	newEnvelope, err := wrapDataKey(path, newHdr, newkek, keptKey, e, dataKey)
+
+	if err != nil {
+		return err
+	}
+
+	return writeEnvelopedRecord(path, newHdr, newEnvelope, payload)
+}
+
+// CheckKey verifies the key-encryption key against the record given with path without decrypting the payload
+// if possible. It returns false if the record is not protected by the key-encryption key at all, which is the
+// case for records written by recipients without the masterpassword.
+func CheckKey(path string, kek crypto.Key) (bool, error) {
+	f, _, hdr, err := openRecordfile(path)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	if hdr.FormatVersion < LokiFormatVersion4 {
+		_, _, err := LoadRecord(path, kek)
+		return true, err
+	}
+
+	envelope, _, err := readEnvelopedRecord(f, &hdr)
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(envelope.WrappedKey) == 0 {
+		return false, nil
+	}
+
+	e, err := crypto.NewEngineForCipher(hdr.Cipher)
+
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := kek.Decrypt(e, envelope.WrappedKey, keyWrapData(hdr.FormatVersion, hdr.Generation, hdr.PayloadSize, hdr.Cipher)); err != nil {
+		return true, errors.New("unable to decrypt, password?")
+	}
+
+	return true, nil
+}
+
+func createHeader(version uint32, generation uint32, payloadSize uint32) []byte {
+	header := make([]byte, LokiBaseHeaderSize)
 
 	header[0] = MagicValue1
 	header[1] = MagicValue2
 	header[2] = MagicValue3
 	header[3] = MagicValue4
 
-	binary.BigEndian.PutUint32(header[4:], LokiFormatVersion)
+	binary.BigEndian.PutUint32(header[4:], version)
 	binary.BigEndian.PutUint32(header[8:], generation)
-	binary.BigEndian.PutUint32(header[12:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[12:], payloadSize)
 
-	checksum := crypto.ComputeMD5checksum(payload)
-	return append(header[:], checksum...)
+	return header
 }
 
-// LoadRecord returns a valid record if it could decrypt with the given key the file provided with filename.
-func LoadRecord(filename string, key []byte) (*pb.Record, *DataFileHeader, error) {
-
+// openRecordfile opens the lokifile given with filename and parses the common part of the header. The file
+// is positioned right behind it. The caller has to close the file.
+func openRecordfile(filename string) (*os.File, []byte, DataFileHeader, error) {
 	f, err := os.Open(filename)
 
 	if err != nil {
-		return &pb.Record{}, &DataFileHeader{}, errors.New("file not found")
+		return nil, nil, DataFileHeader{}, errors.New("file not found")
 	}
 
-	defer f.Close()
+	header := make([]byte, LokiBaseHeaderSize)
 
-	header := make([]byte, LokiHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		f.Close()
+		return nil, nil, DataFileHeader{}, fmt.Errorf("header corrupted: %v", err)
+	}
 
-	n1, err := f.Read(header)
+	hdr, err := parseHeader(header)
 
 	if err != nil {
-		return &pb.Record{}, &DataFileHeader{}, fmt.Errorf("error reading header: %v", err)
+		f.Close()
+		return nil, nil, DataFileHeader{}, fmt.Errorf("error parsing header: %v", err)
 	}
 
-	if n1 != LokiHeaderSize {
-		return &pb.Record{}, &DataFileHeader{}, fmt.Errorf("header corrupted")
-	}
+	return f, header, hdr, nil
+}
 
-	hdr, err := parseHeader(header)
+// LoadHeader reads and parses the unencrypted header of the lokifile given with filename.
+// No key is needed for this.
+func LoadHeader(filename string) (*DataFileHeader, error) {
+	f, _, hdr, err := openRecordfile(filename)
 
 	if err != nil {
-		return &pb.Record{}, &DataFileHeader{}, fmt.Errorf("error parsing header: %v", err)
+		return &DataFileHeader{}, err
 	}
 
-	// hdr.Print()
+	defer f.Close()
 
-	payload, err := readPayload(f, hdr.PayloadSize)
+	if hdr.FormatVersion >= LokiFormatVersion3 {
+		fields := make([]byte, LokiHeaderSizeV4-LokiBaseHeaderSize)
 
-	if err != nil {
-		return &pb.Record{}, &DataFileHeader{}, err
-	}
+		if _, err := io.ReadFull(f, fields[:LokiHeaderSizeV3-LokiBaseHeaderSize]); err != nil {
+			return &DataFileHeader{}, fmt.Errorf("header corrupted: %v", err)
+		}
 
-	// decrypt
-	decryptedPayload, err := engine.Decrypt(payload, key)
+		hdr.Cipher = crypto.Cipher(binary.BigEndian.Uint32(fields[0:4]))
 
-	rec := &pb.Record{}
+		if hdr.FormatVersion >= LokiFormatVersion4 {
+			if _, err := io.ReadFull(f, fields[4:]); err != nil {
+				return &DataFileHeader{}, fmt.Errorf("header corrupted: %v", err)
+			}
 
-	if err != nil {
-		return rec, &DataFileHeader{}, errors.New("unable to decrypt, password?")
+			hdr.EnvelopeSize = binary.BigEndian.Uint32(fields[4:8])
+		}
 	}
 
-	err = proto.Unmarshal(decryptedPayload, rec)
+	return &hdr, nil
+}
+
+// LoadRecord returns a valid record if it could decrypt the file provided with filename using the given
+// key-encryption key, held locally or by the agent. The format version given in the header selects the parser.
+func LoadRecord(filename string, kek crypto.Key) (*pb.Record, *DataFileHeader, error) {
+
+	f, header, hdr, err := openRecordfile(filename)
 
 	if err != nil {
-		return rec, &DataFileHeader{}, errors.New("error unmarshaling payload")
+		return &pb.Record{}, &DataFileHeader{}, err
 	}
 
-	if !crypto.VerifyMD5(payload, hdr.PayloadMD5) {
-		return rec, &DataFileHeader{}, errors.New("md5 checksum incorrect")
+	defer f.Close()
+
+	parser, ok := formatParsers[hdr.FormatVersion]
+
+	if !ok {
+		return &pb.Record{}, &DataFileHeader{}, fmt.Errorf("unsupported format version: %d", hdr.FormatVersion)
 	}
 
-	if rec.Md5 != ComputeInnerMd5(*rec) {
-		return rec, &DataFileHeader{}, errors.New("inner MD5 checksum incorrect")
+	rec, err := parser(f, header, &hdr, kek)
+
+	if err != nil {
+		return rec, &DataFileHeader{}, err
 	}
 
 	if rec.Magic != config.InnerMagic {
@@ -163,7 +462,39 @@ func LoadRecord(filename string, key []byte) (*pb.Record, *DataFileHeader, error
 	return rec, &hdr, nil
 }
 
-func readPayload(f *os.File, payloadsize uint32) ([]byte, error) {
+func decryptPayload(e crypto.Engine, payload []byte, key crypto.Key, additionalData []byte) (*pb.Record, error) {
+	return decryptPaddedPayload(e, payload, key, additionalData, false)
+}
+
+// decryptPaddedPayload decrypts the payload and removes the padding if padded is given, before it is unmarshaled.
+func decryptPaddedPayload(e crypto.Engine, payload []byte, key crypto.Key, additionalData []byte, padded bool) (*pb.Record, error) {
+	rec := &pb.Record{}
+
+	decryptedPayload, err := key.Decrypt(e, payload, additionalData)
+
+	if err != nil {
+		return rec, errors.New("unable to decrypt, password?")
+	}
+
+	if padded {
+		if decryptedPayload, err = unpad(decryptedPayload); err != nil {
+			return rec, err
+		}
+	}
+
+	if err = proto.Unmarshal(decryptedPayload, rec); err != nil {
+		return rec, errors.New("error unmarshaling payload")
+	}
+
+	return rec, nil
+}
+
+// readPayload reads the encrypted payload following the header into memory as a whole. The payload is sealed with
+// a single AEAD operation, which authenticates all of it before any plaintext is released, so it could not be
+// decrypted while streaming in. Segmenting the payload would take a new format version. The payload size given in
+// the header is checked against the file size and the limit, MaxRecordSize plus nonce and tag, before the buffer
+// is allocated, so a forged header could not make loki allocate more than the file holds.
+func readPayload(f *os.File, headersize int, payloadsize uint32) ([]byte, error) {
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, errors.New("Could not stat file")
@@ -173,18 +504,21 @@ func readPayload(f *os.File, payloadsize uint32) ([]byte, error) {
 
 	// verify given payload size against headersize + file-length
 
-	if int64(LokiHeaderSize)+int64(payloadsize) != filesize {
+	if int64(headersize)+int64(payloadsize) != filesize {
 		return nil, fmt.Errorf("Sizes do not match. Headersize: %d, Given payload: %d, Filesize: %d",
-			LokiHeaderSize, payloadsize, filesize)
+			headersize, payloadsize, filesize)
 	}
 
-	buffer := make([]byte, payloadsize)
-	bytesRead, err := f.Read(buffer)
+	if payloadsize > maxPayloadSize {
+		return nil, fmt.Errorf("Payload too large: %d bytes, the limit is %d bytes", payloadsize, maxPayloadSize)
+	}
 
-	if bytesRead != int(payloadsize) {
+	payload := make([]byte, payloadsize)
+
+	if _, err := io.ReadFull(f, payload); err != nil {
 		return nil, errors.New("Could not read Payload")
 	}
-	return buffer, nil
+	return payload, nil
 }
 
 func verifyMagic(magic []byte) bool {
@@ -199,7 +533,7 @@ func verifyMagic(magic []byte) bool {
 
 func parseHeader(header []byte) (DataFileHeader, error) {
 
-	if len(header) != LokiHeaderSize {
+	if len(header) != LokiBaseHeaderSize {
 		return DataFileHeader{}, errors.New("header size incorrect")
 	}
 
@@ -212,9 +546,7 @@ func parseHeader(header []byte) (DataFileHeader, error) {
 	hdr.FormatVersion = binary.BigEndian.Uint32(header[4:8])
 	hdr.Generation = binary.BigEndian.Uint32(header[8:12])
 	hdr.PayloadSize = binary.BigEndian.Uint32(header[12:16])
-
-	hdr.PayloadMD5 = make([]byte, 16)
-	copy(hdr.PayloadMD5, header[16:])
+	hdr.Cipher = crypto.CipherAES256GCM
 
 	return hdr, nil
 }
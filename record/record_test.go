@@ -0,0 +1,466 @@
+package record
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"loki/config"
+	"loki/crypto"
+	pb "loki/storage"
+)
+
+// IMPORTANT: This is the key for the empty "" password the testdata is encrypted with.
+const testKey = "f54d6aba8329dea96d4b3daa8caaa05e06bd10c246a40d510d2feb3e73b620bb"
+
+// localKey returns the hex encoded key as key held in memory.
+func localKey(h string) crypto.LocalKey {
+	key, _ := hex.DecodeString(h)
+	return key
+}
+
+func randomKey() crypto.LocalKey {
+	key, _ := crypto.NewRandomKey()
+	return key
+}
+
+func tempRecordfile(t *testing.T) string {
+	dir, err := ioutil.TempDir(os.TempDir(), "loki_record_test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "test.loki")
+}
+
+func TestLoadFormatV1(t *testing.T) {
+	key := localKey(testKey)
+
+	rec, hdr, err := LoadRecord("../data/test/minimal/file1.loki", key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.FormatVersion != LokiFormatVersion1 || len(hdr.PayloadMD5) != 16 || len(rec.Title) == 0 {
+		t.Fail()
+	}
+}
+
+func TestLoadFormatV2(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	rec := pb.Record{Title: "title", Password: "secret", Magic: config.InnerMagic}
+	serialized, _ := proto.Marshal(&rec)
+
+	// AES-GCM adds a 12 byte nonce and a 16 byte tag
+	hdr := createHeader(LokiFormatVersion2, 7, uint32(len(serialized)+12+16))
+	payload, _ := crypto.NewEngine().Encrypt(serialized, key, hdr)
+	ioutil.WriteFile(filename, append(hdr, payload...), 0600)
+
+	loaded, loadedHdr, err := LoadRecord(filename, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loadedHdr.FormatVersion != LokiFormatVersion2 || loadedHdr.Generation != 7 || loaded.Password != "secret" {
+		t.Fail()
+	}
+}
+
+func TestWriteAndLoad(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	for _, c := range []crypto.Cipher{crypto.CipherXChaCha20Poly1305, crypto.CipherAES256GCM} {
+		if err := SetCipher(c); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := WriteRecord(filename, 7, key, &pb.Record{Title: "title", Password: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+
+		rec, hdr, err := LoadRecord(filename, key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.FormatVersion != LokiFormatVersion || hdr.Generation != 7 || hdr.Cipher != c || rec.Password != "secret" || rec.Md5 != "" {
+			t.Fail()
+		}
+	}
+}
+
+func TestTamperedHeader(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	if err := WriteRecord(filename, 7, key, &pb.Record{Title: "title"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(filename)
+
+	// raise the generation from 7 to 8
+	data[11]++
+	ioutil.WriteFile(filename, data, 0600)
+
+	if _, _, err := LoadRecord(filename, key); err == nil {
+		t.Fail()
+	}
+}
+
+func TestTamperedCipher(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	if err := WriteRecord(filename, 7, key, &pb.Record{Title: "title"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(filename)
+
+	// switch from AES-256-GCM to XChaCha20-Poly1305
+	data[19] = byte(crypto.CipherXChaCha20Poly1305)
+	ioutil.WriteFile(filename, data, 0600)
+
+	if _, _, err := LoadRecord(filename, key); err == nil {
+		t.Fail()
+	}
+}
+
+func TestLoadFormatV3(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	rec := pb.Record{Title: "title", Password: "secret", Magic: config.InnerMagic}
+	serialized, _ := proto.Marshal(&rec)
+
+	e, _ := crypto.NewEngineForCipher(crypto.CipherXChaCha20Poly1305)
+	// XChaCha20-Poly1305 adds a 24 byte nonce and a 16 byte tag
+	hdr := keyWrapData(LokiFormatVersion3, 7, uint32(len(serialized)+24+16), e.Cipher())
+	payload, _ := e.Encrypt(serialized, key, hdr)
+	ioutil.WriteFile(filename, append(hdr, payload...), 0600)
+
+	loaded, loadedHdr, err := LoadRecord(filename, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loadedHdr.FormatVersion != LokiFormatVersion3 || loadedHdr.Cipher != e.Cipher() || loaded.Password != "secret" {
+		t.Fail()
+	}
+}
+
+func TestLoadFormatV4(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	rec := pb.Record{Title: "title", Password: "secret", Magic: config.InnerMagic}
+	serialized, _ := proto.Marshal(&rec)
+	dataKey, _ := crypto.NewRandomKey()
+	e := crypto.NewEngine()
+
+	// version 4 encrypts the serialized record without padding
+	payload, _ := e.Encrypt(serialized, dataKey, nil)
+	hdr := keyWrapData(LokiFormatVersion4, 7, uint32(len(payload)), e.Cipher())
+	envelope, _ := wrapDataKey(filename, hdr, key, nil, e, dataKey)
+
+	if err := writeEnvelopedRecord(filename, hdr, envelope, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, loadedHdr, err := LoadRecord(filename, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loadedHdr.FormatVersion != LokiFormatVersion4 || loaded.Password != "secret" {
+		t.Fail()
+	}
+
+	newkey := randomKey()
+
+	// re-wrapping keeps the format version, the payload is not touched
+	if err := ChangeKey(filename, 8, key, newkey); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, loadedHdr, err := LoadRecord(filename, newkey); err != nil || loadedHdr.FormatVersion != LokiFormatVersion4 {
+		t.Fatal(err)
+	}
+}
+
+func TestChangeKey(t *testing.T) {
+	oldkey := localKey(testKey)
+	newkey := randomKey()
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	if err := WriteRecord(filename, 7, oldkey, &pb.Record{Title: "title", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := ioutil.ReadFile(filename)
+
+	if err := ChangeKey(filename, 8, oldkey, newkey); err != nil {
+		t.Fatal(err)
+	}
+
+	after, _ := ioutil.ReadFile(filename)
+
+	// the encrypted payload must not change
+	if !bytes.Equal(before[len(before)-40:], after[len(after)-40:]) {
+		t.Error("payload was re-encrypted")
+	}
+
+	if _, _, err := LoadRecord(filename, oldkey); err == nil {
+		t.Error("old key still works")
+	}
+
+	rec, hdr, err := LoadRecord(filename, newkey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Generation != 8 || rec.Password != "secret" {
+		t.Fail()
+	}
+}
+
+func TestChangeKeyUpgradesOldFormats(t *testing.T) {
+	oldkey := localKey(testKey)
+	newkey := randomKey()
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	data, _ := ioutil.ReadFile("../data/test/minimal/file1.loki")
+	ioutil.WriteFile(filename, data, 0600)
+
+	if err := ChangeKey(filename, 2, oldkey, newkey); err != nil {
+		t.Fatal(err)
+	}
+
+	_, hdr, err := LoadRecord(filename, newkey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.FormatVersion != LokiFormatVersion || hdr.Generation != 2 || hdr.EnvelopeSize == 0 {
+		t.Fail()
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	key := localKey(testKey)
+	alice, _ := crypto.NewIdentity()
+	bob, _ := crypto.NewIdentity()
+	base := filepath.Dir(tempRecordfile(t))
+	defer os.RemoveAll(base)
+	defer SetIdentityLoader(nil)
+
+	team := filepath.Join(base, "team")
+	os.Mkdir(team, 0700)
+	ioutil.WriteFile(filepath.Join(base, config.MasterFilename), []byte{}, 0600)
+
+	if err := StoreRecipients(team, []Recipient{{PublicKey: alice.PublicKey, Name: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if recipients, err := FindRecipients(team); err != nil || len(recipients) != 1 || recipients[0].Name != "alice" {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(team, "test.loki")
+
+	if err := WriteRecord(filename, 1, key, &pb.Record{Title: "title", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	SetIdentityLoader(func() (*crypto.Identity, error) { return bob, nil })
+
+	if _, _, err := LoadRecord(filename, nil); err == nil {
+		t.Error("record readable by non recipient")
+	}
+
+	SetIdentityLoader(func() (*crypto.Identity, error) { return alice, nil })
+
+	if rec, _, err := LoadRecord(filename, nil); err != nil || rec.Password != "secret" {
+		t.Error("record not readable by recipient")
+	}
+
+	// the recipient could write without the masterkey, the masterkey wrap is kept
+	if err := ChangeKey(filename, 1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	SetIdentityLoader(nil)
+
+	if _, _, err := LoadRecord(filename, key); err != nil {
+		t.Error("masterkey wrap lost")
+	}
+
+	if err := WriteRecord(filepath.Join(base, "outside.loki"), 1, nil, &pb.Record{Title: "title"}); err == nil {
+		t.Error("record without any key written")
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+	defer func() { timeNow = time.Now }()
+
+	write := func(at int64, rec *pb.Record) *pb.Record {
+		timeNow = func() time.Time { return time.Unix(at, 0) }
+
+		if err := WriteRecord(filename, 7, key, rec); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, _, err := LoadRecord(filename, key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return loaded
+	}
+
+	rec := write(100, &pb.Record{Password: "secret", Expires: 1000})
+
+	if rec.Created != 100 || rec.Modified != 100 || rec.PasswordChanged != 100 || rec.Expires != 1000 {
+		t.Errorf("new record: %v", rec)
+	}
+
+	rec.Title = "title"
+	rec = write(200, rec)
+
+	if rec.Created != 100 || rec.Modified != 200 || rec.PasswordChanged != 100 {
+		t.Errorf("title changed: %v", rec)
+	}
+
+	rec.Password = "other"
+	rec = write(300, rec)
+
+	if rec.Created != 100 || rec.Modified != 300 || rec.PasswordChanged != 300 {
+		t.Errorf("password changed: %v", rec)
+	}
+
+	// rewriting, e.g. when changing the key, keeps the timestamps
+	newkey := randomKey()
+
+	if err := RewriteRecord(filename, 8, newkey, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded, _, err := LoadRecord(filename, newkey); err != nil || loaded.Modified != 300 {
+		t.Errorf("rewritten record: %v %v", loaded, err)
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+	defer SetHistoryLimit(DefaultHistoryLimit)
+
+	SetHistoryLimit(2)
+	rec := &pb.Record{}
+
+	for _, password := range []string{"1", "2", "3", "4"} {
+		rec.Password = password
+
+		if err := WriteRecord(filename, 7, key, rec); err != nil {
+			t.Fatal(err)
+		}
+
+		rec, _, _ = LoadRecord(filename, key)
+	}
+
+	if len(rec.History) != 2 || rec.History[0].Password != "3" || rec.History[1].Password != "2" {
+		t.Errorf("unexpected history: %v", rec.History)
+	}
+
+	if limit, err := ParseHistoryLimit(""); err != nil || limit != DefaultHistoryLimit {
+		t.Error("no default limit")
+	}
+
+	if _, err := ParseHistoryLimit("-1"); err == nil {
+		t.Error("negative limit accepted")
+	}
+}
+
+func TestWriteNewRecord(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	if err := WriteRecord(filename, 7, key, &pb.Record{Password: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the record replaced is an unrelated one, its password stays out of the history
+	if err := WriteNewRecord(filename, 7, key, &pb.Record{Password: "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec, _, err := LoadRecord(filename, key); err != nil || rec.Password != "new" || len(rec.History) > 0 {
+		t.Errorf("unexpected record: %v", rec)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	key := localKey(testKey)
+	filename := tempRecordfile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	attachment := &pb.Attachment{Name: "large", Data: make([]byte, MaxRecordSize)}
+
+	if err := WriteRecord(filename, 7, key, &pb.Record{Attachments: []*pb.Attachment{attachment}}); err == nil {
+		t.Error("record above the limit written")
+	}
+
+	attachment.Data = make([]byte, 64*1024)
+
+	if err := WriteRecord(filename, 7, key, &pb.Record{Attachments: []*pb.Attachment{attachment}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec, _, err := LoadRecord(filename, key); err != nil || len(rec.Attachments[0].Data) != len(attachment.Data) {
+		t.Errorf("attachment not loaded: %v", err)
+	}
+
+	// a sparse file matching a forged payload size above the limit
+	if err := ioutil.WriteFile(filename, createHeader(LokiFormatVersion2, 7, maxPayloadSize+1), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(filename, int64(LokiHeaderSizeV2)+int64(maxPayloadSize)+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := LoadRecord(filename, key); err == nil {
+		t.Error("payload above the limit read")
+	}
+}
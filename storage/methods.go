@@ -9,6 +9,7 @@ import (
 	"loki/log"
 	"os"
 	"strings"
+	"time"
 )
 
 // Edit lets you edit the given record. Editing of the Notes field ends with CTRL-D.
@@ -30,15 +31,31 @@ func (rec *Record) Edit(editNotes bool) error {
 	}
 	rec.Title = editedValue
 
-	if editedValue, err = line.PromptWithSuggestion(config.AccountLabel, rec.Account, pos); err != nil {
-		return aborted
+	if rec.Type == RecordType_LOGIN {
+		if editedValue, err = line.PromptWithSuggestion(config.AccountLabel, rec.Account, pos); err != nil {
+			return aborted
+		}
+		rec.Account = editedValue
+
+		if editedValue, err = line.PromptWithSuggestion(config.PasswordLabel, rec.Password, pos); err != nil {
+			return aborted
+		}
+		rec.Password = editedValue
+	}
+
+	if rec.Type == RecordType_SSH_KEY {
+		if rec.GetSshKey().GetPrivateKey() != "" {
+			log.Info("Private key, empty keeps the current one:")
+		}
+
+		if err = readPrivateKey(line, rec); err != nil {
+			return aborted
+		}
 	}
-	rec.Account = editedValue
 
-	if editedValue, err = line.PromptWithSuggestion(config.PasswordLabel, rec.Password, pos); err != nil {
+	if err = promptTyped(line, rec, true); err != nil {
 		return aborted
 	}
-	rec.Password = editedValue
 
 	tagsString := strings.Join(rec.Tags, ", ")
 
@@ -47,10 +64,29 @@ func (rec *Record) Edit(editNotes bool) error {
 	}
 	rec.Tags = tagsStringToArray(editedValue)
 
-	if editedValue, err = line.PromptWithSuggestion(config.URLLabel, rec.Url, pos); err != nil {
+	if rec.Type == RecordType_LOGIN {
+		if editedValue, err = line.PromptWithSuggestion(config.URLLabel, rec.Url, pos); err != nil {
+			return aborted
+		}
+		rec.Url = editedValue
+
+		if editedValue, err = line.PromptWithSuggestion(config.OTPLabel, rec.Otpauth, pos); err != nil {
+			return aborted
+		}
+		rec.Otpauth = strings.TrimSpace(editedValue)
+	}
+
+	if editedValue, err = line.PromptWithSuggestion(config.ExpiresLabel, FormatDate(rec.Expires), pos); err != nil {
+		return aborted
+	}
+
+	if rec.Expires, err = ParseDate(editedValue); err != nil {
+		return err
+	}
+
+	if rec.Fields, err = editFields(line, rec.Fields); err != nil {
 		return aborted
 	}
-	rec.Url = editedValue
 
 	if editNotes {
 		// handle multi-line notes
@@ -116,10 +152,217 @@ func (rec *Record) Search(text string) bool {
 	if strings.Contains(strings.ToLower(rec.Notes), text) {
 		return true
 	}
+	for _, field := range rec.TypedFields() {
+		if strings.Contains(strings.ToLower(*field.Value), text) {
+			return true
+		}
+	}
+	for _, attachment := range rec.Attachments {
+		if strings.Contains(strings.ToLower(attachment.Name), text) {
+			return true
+		}
+	}
+	for _, field := range rec.Fields {
+		if strings.Contains(strings.ToLower(field.Name), text) || strings.Contains(strings.ToLower(field.Value), text) {
+			return true
+		}
+	}
 
 	return false
 }
 
+// Label returns the field name formatted like the labels of the fixed fields.
+func (field *Field) Label() string {
+	return fmt.Sprintf("%-12s: ", field.Name)
+}
+
+// editFields lets the user edit the given custom fields one after the other. Clearing the name removes a
+// field. Afterwards new fields are asked for until an empty name is given.
+func editFields(line *liner.State, fields []*Field) ([]*Field, error) {
+	edited := []*Field{}
+
+	for _, field := range fields {
+		name, err := line.PromptWithSuggestion(config.FieldLabel, field.Name, -1)
+
+		if err != nil {
+			return fields, err
+		}
+
+		if len(strings.TrimSpace(name)) == 0 {
+			continue
+		}
+
+		value, err := line.PromptWithSuggestion(config.ValueLabel, field.Value, -1)
+
+		if err != nil {
+			return fields, err
+		}
+
+		concealed, err := line.PromptWithSuggestion(config.ConcealLabel, yesNo(field.Concealed), -1)
+
+		if err != nil {
+			return fields, err
+		}
+
+		edited = append(edited, &Field{Name: strings.TrimSpace(name), Value: value, Concealed: isYes(concealed)})
+	}
+
+	for {
+		name, err := line.Prompt(config.FieldLabel)
+
+		if err != nil {
+			return fields, err
+		}
+
+		if len(strings.TrimSpace(name)) == 0 {
+			return edited, nil
+		}
+
+		value, err := line.Prompt(config.ValueLabel)
+
+		if err != nil {
+			return fields, err
+		}
+
+		concealed, err := line.Prompt(config.ConcealLabel)
+
+		if err != nil {
+			return fields, err
+		}
+
+		edited = append(edited, &Field{Name: strings.TrimSpace(name), Value: value, Concealed: isYes(concealed)})
+	}
+}
+
+// promptTyped asks for the fields specific to the type of the record. Input failing the check of a field is
+// reported and asked for again. With suggest the current values are proposed.
+func promptTyped(line *liner.State, rec *Record, suggest bool) error {
+	rec.createTyped()
+
+	for _, field := range rec.TypedFields() {
+		for {
+			var value string
+			var err error
+
+			if suggest {
+				value, err = line.PromptWithSuggestion(field.Label, *field.Value, -1)
+			} else {
+				value, err = line.Prompt(field.Label)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			value = strings.TrimSpace(value)
+
+			if field.Check != nil {
+				if err := field.Check(value); err != nil {
+					log.Error("%v", err)
+					continue
+				}
+			}
+
+			*field.Value = value
+			break
+		}
+	}
+
+	return nil
+}
+
+// readPrivateKey reads a PEM encoded private key line by line up to its END line. An empty first line keeps the
+// current key. Keys which could not be parsed are reported and asked for again.
+func readPrivateKey(line *liner.State, rec *Record) error {
+	if rec.SshKey == nil {
+		rec.SshKey = &SSHKey{}
+	}
+
+	for {
+		key := ""
+		prompt := config.PrivateKeyLabel
+
+		for {
+			input, err := line.Prompt(prompt)
+
+			if err != nil {
+				return err
+			}
+
+			input = strings.TrimSpace(input)
+
+			if len(key) == 0 && len(input) == 0 {
+				return nil
+			}
+
+			key += input + "\n"
+			prompt = ""
+
+			if strings.HasPrefix(input, "-----END") {
+				break
+			}
+		}
+
+		if err := CheckPrivateKey(key, ""); err != nil {
+			log.Error("%v", err)
+			continue
+		}
+
+		rec.SshKey.PrivateKey = key
+		return nil
+	}
+}
+
+// Attachment returns the attachment with the given name, nil if there is none.
+func (rec *Record) Attachment(name string) *Attachment {
+	for _, attachment := range rec.Attachments {
+		if attachment.Name == name {
+			return attachment
+		}
+	}
+
+	return nil
+}
+
+// ParseDate parses a date given as YYYY-MM-DD into unix time, the start of the day in local time. An empty
+// string gives 0, i.e. no date.
+func ParseDate(date string) (int64, error) {
+	date = strings.TrimSpace(date)
+
+	if len(date) == 0 {
+		return 0, nil
+	}
+
+	t, err := time.ParseInLocation(config.DateFormat, date, time.Local)
+
+	if err != nil {
+		return 0, fmt.Errorf("Invalid date, expected YYYY-MM-DD: %s", date)
+	}
+
+	return t.Unix(), nil
+}
+
+// FormatDate formats unix time as YYYY-MM-DD, 0 gives an empty string.
+func FormatDate(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+
+	return time.Unix(unix, 0).Format(config.DateFormat)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func isYes(answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 // split Tags like: "wlan, web, imported, mobile" into array
 func tagsStringToArray(tagsString string) []string {
 	tags := strings.Split(tagsString, ",")
@@ -135,9 +378,9 @@ func tagsStringToArray(tagsString string) []string {
 	return trimmedTags
 }
 
-// Ask prompts the user for the content of all fields in the record.
-func Ask() (Record, error) {
-	rec := Record{}
+// Ask prompts the user for the content of all fields of a record of the given type.
+func Ask(kind RecordType) (*Record, error) {
+	rec := &Record{Type: kind}
 
 	line := liner.NewLiner()
 	defer line.Close()
@@ -149,11 +392,25 @@ func Ask() (Record, error) {
 		return rec, err
 	}
 
-	if rec.Account, err = line.Prompt(config.AccountLabel); err != nil {
-		return rec, err
+	if kind == RecordType_LOGIN {
+		if rec.Account, err = line.Prompt(config.AccountLabel); err != nil {
+			return rec, err
+		}
+
+		if rec.Password, err = line.Prompt(config.PasswordLabel); err != nil {
+			return rec, err
+		}
 	}
 
-	if rec.Password, err = line.Prompt(config.PasswordLabel); err != nil {
+	if kind == RecordType_SSH_KEY {
+		log.Info("Private key, paste it up to its END line or leave empty:")
+
+		if err = readPrivateKey(line, rec); err != nil {
+			return rec, err
+		}
+	}
+
+	if err = promptTyped(line, rec, false); err != nil {
 		return rec, err
 	}
 
@@ -165,7 +422,30 @@ func Ask() (Record, error) {
 
 	rec.Tags = tagsStringToArray(tagsString)
 
-	if rec.Url, err = line.Prompt(config.URLLabel); err != nil {
+	if kind == RecordType_LOGIN {
+		if rec.Url, err = line.Prompt(config.URLLabel); err != nil {
+			return rec, err
+		}
+
+		if rec.Otpauth, err = line.Prompt(config.OTPLabel); err != nil {
+			return rec, err
+		}
+		rec.Otpauth = strings.TrimSpace(rec.Otpauth)
+	}
+
+	var expires string
+
+	if expires, err = line.Prompt(config.ExpiresLabel); err != nil {
+		return rec, err
+	}
+
+	if rec.Expires, err = ParseDate(expires); err != nil {
+		return rec, err
+	}
+
+	log.Info("Custom fields, end with an empty name:")
+
+	if rec.Fields, err = editFields(line, nil); err != nil {
 		return rec, err
 	}
 
@@ -200,4 +480,11 @@ func (masterfile *MasterFile) Print(spacing int) {
 	log.Debug("%*sMagic      : %s", spacing, "", masterfile.Magic)
 	log.Debug("%*sMD5        : %s", spacing, "", masterfile.Md5)
 	log.Debug("%*sGeneration : %d", spacing, "", masterfile.Generation)
+	log.Debug("%*sKDF        : %s", spacing, "", masterfile.Kdf)
+	log.Debug("%*sSalt       : %x", spacing, "", masterfile.Salt)
+	log.Debug("%*sCosts      : time=%d, memory=%d KiB, threads=%d", spacing, "", masterfile.Time, masterfile.Memory, masterfile.Threads)
+	log.Debug("%*sKey check  : %t", spacing, "", len(masterfile.Verifier) > 0)
+	log.Debug("%*sKeyfile    : %t", spacing, "", masterfile.KeyfileRequired)
+	log.Debug("%*sHidden     : %t", spacing, "", masterfile.HiddenNames)
+	log.Debug("%*sStore ID   : %s", spacing, "", masterfile.StoreId)
 }
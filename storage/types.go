@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+
+	"crypto/x509"
+
+	"golang.org/x/crypto/ssh"
+	"loki/config"
+)
+
+var typeNames = map[RecordType]string{
+	RecordType_LOGIN:       "login",
+	RecordType_CARD:        "card",
+	RecordType_SSH_KEY:     "ssh",
+	RecordType_SECURE_NOTE: "note",
+	RecordType_IDENTITY:    "identity",
+}
+
+// TypeFromName returns the record type with the given name as used on the commandline.
+func TypeFromName(name string) (RecordType, error) {
+	for t, n := range typeNames {
+		if strings.EqualFold(n, name) {
+			return t, nil
+		}
+	}
+
+	return RecordType_LOGIN, errors.New("unknown record type: " + name + ", valid are login, card, ssh, note and identity")
+}
+
+// Name returns the name of the record type as used on the commandline.
+func (t RecordType) Name() string {
+	return typeNames[t]
+}
+
+// TypedField is one of the fields specific to the type of a record. Logins keep using the fixed fields of the
+// record, all other types have their own set.
+type TypedField struct {
+	Label  string
+	Value  *string
+	Secret bool               // masked in Blindmode
+	Check  func(string) error // validates the input, if given
+}
+
+// TypedFields returns the fields specific to the type of the record. If the message holding them is missing, the
+// fields are empty and the record is left untouched, values written through them get lost then. Editing creates
+// the message with createTyped first.
+func (rec *Record) TypedFields() []TypedField {
+	switch rec.Type {
+	case RecordType_CARD:
+		card := rec.Card
+
+		if card == nil {
+			card = &Card{}
+		}
+
+		return []TypedField{
+			{config.CardholderLabel, &card.Cardholder, false, nil},
+			{config.NumberLabel, &card.Number, true, CheckCardNumber},
+			{config.ValidThruLabel, &card.Expiry, false, CheckCardExpiry},
+			{config.CVVLabel, &card.Cvv, true, nil},
+			{config.PINLabel, &card.Pin, true, nil},
+		}
+	case RecordType_SSH_KEY:
+		key := rec.SshKey
+
+		if key == nil {
+			key = &SSHKey{}
+		}
+
+		return []TypedField{
+			{config.PassphraseLabel, &key.Passphrase, true, func(passphrase string) error {
+				return CheckPrivateKey(key.PrivateKey, passphrase)
+			}},
+			{config.PublicKeyLabel, &key.PublicKey, false, CheckPublicKey},
+		}
+	case RecordType_IDENTITY:
+		person := rec.Person
+
+		if person == nil {
+			person = &Person{}
+		}
+
+		return []TypedField{
+			{config.NameLabel, &person.Name, false, nil},
+			{config.EmailLabel, &person.Email, false, nil},
+			{config.PhoneLabel, &person.Phone, false, nil},
+			{config.AddressLabel, &person.Address, false, nil},
+			{config.BirthdayLabel, &person.Birthday, false, checkBirthday},
+		}
+	}
+
+	return nil
+}
+
+// createTyped creates the message holding the fields specific to the type of the record if it is missing.
+func (rec *Record) createTyped() {
+	switch rec.Type {
+	case RecordType_CARD:
+		if rec.Card == nil {
+			rec.Card = &Card{}
+		}
+	case RecordType_SSH_KEY:
+		if rec.SshKey == nil {
+			rec.SshKey = &SSHKey{}
+		}
+	case RecordType_IDENTITY:
+		if rec.Person == nil {
+			rec.Person = &Person{}
+		}
+	}
+}
+
+// Secret returns the value copied to the clipboard: the password of logins, the number of cards and the passphrase
+// of SSH keys.
+func (rec *Record) Secret() string {
+	switch rec.Type {
+	case RecordType_CARD:
+		return rec.GetCard().GetNumber()
+	case RecordType_SSH_KEY:
+		return rec.GetSshKey().GetPassphrase()
+	case RecordType_LOGIN:
+		return rec.Password
+	}
+
+	return ""
+}
+
+// CheckCardNumber verifies the Luhn checksum of a card number. Spaces and dashes are ignored.
+func CheckCardNumber(number string) error {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(number)
+
+	if len(digits) == 0 {
+		return nil
+	}
+
+	if len(digits) < 12 || len(digits) > 19 {
+		return errors.New("card numbers have 12 to 19 digits")
+	}
+
+	sum := 0
+
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+
+		if d < 0 || d > 9 {
+			return errors.New("card number contains other characters than digits")
+		}
+
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+	}
+
+	if sum%10 != 0 {
+		return errors.New("card number checksum (Luhn) incorrect")
+	}
+
+	return nil
+}
+
+// CheckCardExpiry verifies the expiry date of a card is given as MM/YY.
+func CheckCardExpiry(expiry string) error {
+	if len(expiry) == 0 {
+		return nil
+	}
+
+	if _, err := time.Parse("01/06", expiry); err != nil {
+		return errors.New("expected MM/YY: " + expiry)
+	}
+
+	return nil
+}
+
+// CheckPrivateKey verifies the key is a PEM encoded private key. Unencrypted keys have to be parsable, keys
+// encrypted the PEM way have to be decryptable with the passphrase, if one is given. Encrypted keys in the
+// OpenSSH format could only be checked for their structure.
+func CheckPrivateKey(key string, passphrase string) error {
+	if len(key) == 0 {
+		return nil
+	}
+
+	block, rest := pem.Decode([]byte(key))
+
+	if block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") || len(bytes.TrimSpace(rest)) > 0 {
+		return errors.New("no PEM encoded private key")
+	}
+
+	if x509.IsEncryptedPEMBlock(block) {
+		if len(passphrase) > 0 {
+			if _, err := ssh.ParseRawPrivateKeyWithPassphrase([]byte(key), []byte(passphrase)); err != nil {
+				return errors.New("passphrase does not decrypt the private key")
+			}
+		}
+
+		return nil
+	}
+
+	if block.Type == "OPENSSH PRIVATE KEY" && openSSHKeyEncrypted(block.Bytes) {
+		return nil
+	}
+
+	if _, err := ssh.ParseRawPrivateKey([]byte(key)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// openSSHKeyEncrypted returns true if the cipher named in the header of an OpenSSH private key is not "none".
+func openSSHKeyEncrypted(data []byte) bool {
+	magic := []byte("openssh-key-v1\x00")
+
+	if !bytes.HasPrefix(data, magic) || len(data) < len(magic)+4 {
+		return false
+	}
+
+	data = data[len(magic):]
+	length := binary.BigEndian.Uint32(data)
+
+	return uint64(len(data)) >= 4+uint64(length) && string(data[4:4+length]) != "none"
+}
+
+// CheckPublicKey verifies a public key given in authorized_keys format.
+func CheckPublicKey(key string) error {
+	if len(key) == 0 {
+		return nil
+	}
+
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+		return errors.New("no public key in authorized_keys format")
+	}
+
+	return nil
+}
+
+func checkBirthday(date string) error {
+	_, err := ParseDate(date)
+	return err
+}
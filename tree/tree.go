@@ -1,6 +1,7 @@
 package tree
 
 import (
+	"loki/crypto"
 	"loki/log"
 	"loki/record"
 	pb "loki/storage"
@@ -32,7 +33,7 @@ func FilteredWalk(dir string, walkFn filepath.WalkFunc) error {
 
 // CreateFilemap produces a map of filenames -> records of all loki-files in the
 // datastore.
-func CreateFilemap(dir string, key []byte) *FileMap {
+func CreateFilemap(dir string, key crypto.Key) *FileMap {
 
 	fm := make(FileMap)
 
@@ -58,40 +59,34 @@ func CreateFilemap(dir string, key []byte) *FileMap {
 	return &fm
 }
 
-// GetFirstRecord walks the given directory tree and returns the
-// very first record found or nil.
-func GetFirstRecord(dir string, key []byte) *pb.Record {
-
-	var first *pb.Record
+// ProbeKey tries the key on the records of the tree given by dir until one protected by the masterkey is found.
+// It returns false if there is no such record.
+func ProbeKey(dir string, key crypto.Key) (bool, error) {
+	var found bool
+	var outError error
 
 	FilteredWalk(dir, func(path string, info os.FileInfo, err error) error {
-		relPath := strings.TrimPrefix(path, dir)
-
-		if len(relPath) == 0 {
+		if info.IsDir() {
 			return nil
 		}
 
-		if !info.IsDir() {
-			rec, _, err := record.LoadRecord(path, key)
-
-			if err != nil {
-				return errors.New("could not load record")
-			}
+		checked, err := record.CheckKey(path, key)
 
-			first = rec
-			return io.EOF
+		if !checked {
+			return nil
 		}
 
-		return nil
+		found, outError = true, err
+		return io.EOF
 	})
 
-	return first
+	return found, outError
 }
 
 // Verify create a filemap of all records in the tree given by base and
 // and unlocked by the parameter key. This alone should verify the tree
 // but to be save we show the title in addition.
-func Verify(base string, key []byte) error {
+func Verify(base string, key crypto.Key) error {
 
 	fm := CreateFilemap(base, key)
 
@@ -2,126 +2,356 @@ package utils
 
 import (
 	"errors"
+	"fmt"
+	"loki/agent"
 	"loki/config"
 	"loki/crypto"
 	"loki/log"
-	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
 )
 
+// the timeouts passed to agents started by SetupKeyAgent
+var (
+	agentIdleTimeout = config.DefaultIdleTimeout
+	agentMaxLifetime = config.DefaultMaxLifetime
+)
+
+// agentCallerCheck restricts agents started by SetupKeyAgent to answer the loki binary only
+var agentCallerCheck = false
+
+// agentSealed makes agents started by SetupKeyAgent keep the key to themselves
+var agentSealed = false
+
+// agentConfirm makes agents started by SetupKeyAgent ask the user before a key is used, the helper instead of the
+// terminal if given. A confirmation covers the further requests of the process for the grace period.
+var (
+	agentConfirm       = false
+	agentConfirmHelper = ""
+	agentConfirmGrace  time.Duration
+)
+
+// the socket the agent is asked on and the logfile of agents started by SetupKeyAgent
+var (
+	agentSocket  = config.DefaultSocketfilePath()
+	agentLogfile = config.DefaultAgentLogfilePath()
+)
+
+// SetAgentPaths sets the socket the agent is asked on and the logfile of agents started from now on.
+func SetAgentPaths(socket string, logfile string) {
+	agentSocket = socket
+	agentLogfile = logfile
+}
+
+// SetAgentCallerCheck makes agents started from now on refuse all processes but the loki binary.
+func SetAgentCallerCheck(enabled bool) {
+	agentCallerCheck = enabled
+}
+
+// SetAgentSealed makes agents started from now on never hand out the key, they encrypt and decrypt on request instead.
+func SetAgentSealed(enabled bool) {
+	agentSealed = enabled
+}
+
+// SetAgentConfirm makes agents started from now on ask the user before a key is handed out or used. The helper
+// program is asked instead of the terminal the agent was started on, if given. A confirmation covers the further
+// requests of the same process for the grace period, 0 asks for every use.
+func SetAgentConfirm(enabled bool, helper string, grace time.Duration) {
+	agentConfirm = enabled
+	agentConfirmHelper = helper
+	agentConfirmGrace = grace
+}
+
+// SetAgentTimeouts sets the idle timeout and the maximum lifetime of agents started from now on, 0 disables them.
+func SetAgentTimeouts(idle time.Duration, lifetime time.Duration) {
+	agentIdleTimeout = idle
+	agentMaxLifetime = lifetime
+}
+
+// ParseAgentTimeout parses a timeout of the agent given in the configfile as duration like "15m" or "8h". An empty
+// value gives the default, "0" disables the timeout.
+func ParseAgentTimeout(value string, dflt time.Duration) (time.Duration, error) {
+	if len(value) == 0 {
+		return dflt, nil
+	}
+
+	if value == "0" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+
+	if err != nil || timeout < 0 {
+		return 0, errors.New("invalid agent timeout: " + value)
+	}
+
+	return timeout, nil
+}
+
 // GetMasterkey tries to get the masterkey from the loki-agent running in the background.
-func GetMasterkey(twice bool) ([]byte, error) {
-	key, err := GetMasterkeyWithAgent(twice, true)
+func GetMasterkey(cfg config.Configuration, twice bool) (crypto.Key, error) {
+	key, err := GetMasterkeyWithAgent(cfg, twice, true)
 
 	if err != nil {
-		return []byte{}, errors.New("Problem getting Masterkey")
+		return nil, fmt.Errorf("Problem getting Masterkey: %v", err)
 	}
 
 	return key, nil
 }
 
 // GetMasterkeyWithAgent tries to get the masterkey possibly from the agent or prompting the user once or twice
-// according the twice flag.
-func GetMasterkeyWithAgent(twice bool, withAgent bool) ([]byte, error) {
+// according the twice flag. The key is derived with the KDF parameters recorded in the stores masterfile.
+// The masterkey is always verified against the key check of the masterfile. If it fails the check but the
+// password unlocks the users identity, nil is returned.
+func GetMasterkeyWithAgent(cfg config.Configuration, twice bool, withAgent bool) (crypto.Key, error) {
+
+	// callers asking twice pin the key, the agent might hold one never confirmed for a store without key check
+	if twice && !HasKeyCheck(cfg.GetMasterfilename()) {
+		log.Debug("No key check in masterfile, not asking the agent.")
+		withAgent = false
+	}
 
 	if withAgent {
-		if key, err := askAgent(); err == nil {
-			log.Debug("Fine, got key from agent : " + Hexdump(key))
-			return key, nil
+		key, err := askAgent(cfg)
+
+		if err == nil {
+			return verifiedMasterkey(cfg, key)
+		}
+
+		// the user refused the key at the agent, asking for the password instead would defeat this
+		if err == agent.ErrDenied || err == agent.ErrConfirmTimeout {
+			return nil, err
 		}
 	}
 
-	kdf := crypto.NewKeyDerivator()
+	kdf, err := LoadKeyDerivator(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
 	password, err := PromptPassword(twice)
 
 	if err != nil {
-		return []byte{}, errors.New("Problem prompting password")
+		return nil, errors.New("Problem prompting password")
 	}
 
-	key := kdf(password)
-	return key, nil
-}
+	key, err := verifiedMasterkey(cfg, crypto.LocalKey(kdf(password)))
 
-func askAgent() ([]byte, error) {
+	if err == nil {
+		return key, nil
+	}
+
+	// Team members unlock with the password of their own identity, they might not know the masterpassword.
+	// There is no masterkey then, only records of their recipients directories are accessible.
+	if tryIdentity(cfg, password) {
+		return nil, nil
+	}
 
-	socketFile := config.GetSocketfilePath()
+	return nil, err
+}
 
-	if _, err := os.Stat(socketFile); err != nil {
-		return []byte{}, errors.New("Socketfile not found")
+func verifiedMasterkey(cfg config.Configuration, key crypto.Key) (crypto.Key, error) {
+	if err := VerifyMasterkey(cfg.GetMasterfilename(), key); err != nil {
+		return nil, err
 	}
 
-	c, err := net.Dial("unix", socketFile)
+	return key, nil
+}
+
+// GetMasterkeyFromAgent returns the masterkey only if the agent holds it, the user is never prompted.
+func GetMasterkeyFromAgent(cfg config.Configuration) (crypto.Key, error) {
+	key, err := askAgent(cfg)
 
 	if err != nil {
-		return []byte{}, errors.New("Dial error")
+		return nil, err
 	}
 
-	defer c.Close()
-
-	key := make([]byte, config.KeyLength)
+	return verifiedMasterkey(cfg, key)
+}
 
-	_, err = c.Write([]byte(config.RequestMagic))
+// PromptMasterkey prompts the user for the password once or twice and turns it into a key using the given KeyDerivator.
+func PromptMasterkey(kdf crypto.KeyDerivator, twice bool) (crypto.LocalKey, error) {
+	password, err := PromptPassword(twice)
 
 	if err != nil {
-		return []byte{}, errors.New("Error writing magic")
+		return nil, errors.New("Problem prompting password")
 	}
 
-	n, err := c.Read(key[:])
+	key := kdf(password)
+	return key, nil
+}
+
+// agentClient returns a client for the agent of the current user.
+func agentClient() *agent.Client {
+	return agent.NewClient(agentSocket)
+}
+
+// agentStore returns the store of cfg as known to the agent: by its ID and the generation of the masterkey.
+func agentStore(cfg config.Configuration) agent.Store {
+	return agent.Store{ID: cfg.StoreID, Generation: cfg.Generation}
+}
+
+// askAgent returns the masterkey of the store held by the agent. A sealed agent keeps the key to itself, it is
+// returned as key encrypting and decrypting through the agent instead. An agent asking for confirmation answers
+// agent.ErrDenied or agent.ErrConfirmTimeout if the user did not confirm.
+func askAgent(cfg config.Configuration) (crypto.Key, error) {
+	client := agentClient()
+	store := agentStore(cfg)
+	key, err := client.GetKey(store)
+
+	if err == agent.ErrSealed {
+		log.Debug("Agent keeps the key, using it through the agent.")
+		return client.Key(store), nil
+	}
 
 	if err != nil {
-		return []byte{}, errors.New("Read error")
+		return nil, err
 	}
 
-	if n != config.KeyLength {
-		return []byte{}, errors.New("Could not read all bytes from socket, but only : " + string(n))
+	if len(key) != config.KeyLength {
+		return nil, fmt.Errorf("Could not read all bytes from socket, but only : %d", len(key))
 	}
 
-	return key, nil
+	log.Debug("Fine, got key from agent, %d bytes.", len(key))
+	return crypto.LocalKey(key), nil
 }
 
-// ShutdownAgent stops the background agent by sending it a stop command on the unix domain socket.
+// ShutdownAgent stops the background agent, it wipes all keys and exits.
 func ShutdownAgent() error {
+	return agentClient().Shutdown()
+}
 
-	socketFile := config.GetSocketfilePath()
+// LockAgent makes the agent wipe the keys of all stores, it keeps running until it expires.
+func LockAgent() error {
+	return agentClient().Lock()
+}
 
-	if _, err := os.Stat(socketFile); err != nil {
-		return err
-	}
+// ForgetAgentKey makes the agent wipe the key of the store given by cfg, the keys of other stores are kept.
+func ForgetAgentKey(cfg config.Configuration) error {
+	return agentClient().Forget(agentStore(cfg))
+}
 
-	c, err := net.Dial("unix", socketFile)
+// QueryAgent returns the state of the agent without waiting for one, an error if none is running.
+func QueryAgent() (agent.Status, error) {
+	return agentClient().Status()
+}
 
-	if err != nil {
-		return err
-	}
+// AgentStatus returns the state of the agent: whether it is locked and when it is going to exit. An agent just started
+// is waited for shortly.
+func AgentStatus() (agent.Status, error) {
+	client := agentClient()
+
+	for i := 0; i < 20; i++ {
+		if client.Ping() == nil {
+			break
+		}
 
-	defer c.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
 
-	_, err = c.Write([]byte(config.ShutdownMagic))
+	return client.Status()
+}
 
-	if err != nil {
-		return err
+// holdsStore tells whether the agent holds the key of the store.
+func holdsStore(status agent.Status, store agent.Store) bool {
+	for _, held := range status.Stores {
+		if held == store {
+			return true
+		}
 	}
 
-	return nil
+	return false
+}
+
+// AgentHoldsKey tells whether the agent holds the key of the store given by cfg, without asking for the key.
+func AgentHoldsKey(cfg config.Configuration) bool {
+	status, err := agentClient().Status()
+	return err == nil && holdsStore(status, agentStore(cfg))
 }
 
-// SetupKeyAgent starts the background daemon to hold the systems key and passes the
-// key on stdin  to the daemon.
-func SetupKeyAgent(key []byte) error {
-	return SetupKeyAgentWithBinpath(key, GetBinaryPath())
+// SetupKeyAgent starts the background daemon to hold the key of the store given by cfg and passes the
+// key on stdin  to the daemon. The daemon exits on its own after the timeouts set with SetAgentTimeouts.
+// A running daemon without the key gets it passed instead. Only a key held locally could be passed.
+func SetupKeyAgent(cfg config.Configuration, key crypto.Key) error {
+	return SetupKeyAgentWithBinpath(cfg, key, GetBinaryPath())
 }
 
-// SetupKeyAgentWithBinpath starts the background daemon to hold the systems key and passes the
+// SetupKeyAgentWithBinpath starts the background daemon to hold the key of the store given by cfg and passes the
 // key on stdin  to the daemon. In addition one can provide the binpath. This is used for testing
 // since the binarypath could not be derived from the main binary in this case.
-func SetupKeyAgentWithBinpath(key []byte, binpath string) error {
-	if _, err := os.Stat(config.GetSocketfilePath()); err == nil {
-		log.Debug("Socketfile found, bail out.")
+func SetupKeyAgentWithBinpath(cfg config.Configuration, key crypto.Key, binpath string) error {
+	local, ok := key.(crypto.LocalKey)
+
+	if !ok || len(local) == 0 {
+		log.Debug("No masterkey at hand, no agent.")
 		return nil
 	}
 
-	cmd := exec.Command(binpath + string(os.PathSeparator) + "loki-agentd")
+	client := agentClient()
+	store := agentStore(cfg)
+
+	// the status tells without asking for the key, which might have to be confirmed
+	if status, err := client.Status(); err == nil {
+		if holdsStore(status, store) {
+			log.Debug("Agent holds the key, bail out.")
+			return nil
+		}
+
+		log.Debug("Agent running without the key, passing it.")
+		return client.UpdateKey(store, local)
+	}
+
+	// the agent refuses to start in a directory others could tamper with, tell why
+	for _, dir := range []string{filepath.Dir(agentSocket), filepath.Dir(agentLogfile)} {
+		if err := agent.PrivateDir(dir); err != nil {
+			log.Error("Not starting the agent: %v", err)
+			return err
+		}
+	}
+
+	// only a socket nobody listens on is left behind, an agent not answering in time keeps its socket
+	if err := client.Ping(); err == agent.ErrNotListening {
+		log.Debug("Removing stale socketfile.")
+		os.Remove(agentSocket)
+	} else if _, err := os.Stat(agentSocket); err == nil {
+		log.Error("Not starting the agent, another one is listening on %s", agentSocket)
+		return errors.New("agent not answering")
+	}
+
+	args := []string{"-idle", agentIdleTimeout.String(), "-lifetime", agentMaxLifetime.String(),
+		"-store", store.ID, "-generation", fmt.Sprint(store.Generation), "-socket", agentSocket, "-log", agentLogfile}
+
+	if agentCallerCheck && !agent.CallerCheckSupported {
+		log.Error("Not starting the agent: CheckCaller is not supported on %s", runtime.GOOS)
+		return errors.New("caller check not supported")
+	}
+
+	if agentCallerCheck {
+		args = append(args, "-caller", binpath+string(os.PathSeparator)+config.BinaryName)
+	}
+
+	if agentSealed {
+		args = append(args, "-sealed")
+	}
+
+	if agentConfirm && len(agentConfirmHelper) > 0 {
+		args = append(args, "-confirm-helper", agentConfirmHelper)
+	} else if agentConfirm {
+		args = append(args, "-confirm")
+	}
+
+	if agentConfirm && agentConfirmGrace > 0 {
+		args = append(args, "-confirm-grace", agentConfirmGrace.String())
+	}
+
+	cmd := exec.Command(binpath+string(os.PathSeparator)+"loki-agentd", args...)
+	// a process group of its own keeps signals from the terminal of loki away, like Ctrl-C at a later prompt
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	childStdin, err := cmd.StdinPipe()
 
 	if err != nil {
@@ -136,7 +366,7 @@ func SetupKeyAgentWithBinpath(key []byte, binpath string) error {
 
 	log.Debug("Sucessfully started agent, Path : " + cmd.Path)
 
-	n, err := childStdin.Write(key)
+	n, err := childStdin.Write(local)
 
 	if err != nil {
 		return err
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAgentTimeout(t *testing.T) {
+	for _, v := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", time.Minute},
+		{"0", 0},
+		{"90s", 90 * time.Second},
+		{"8h", 8 * time.Hour},
+	} {
+		if timeout, err := ParseAgentTimeout(v.value, time.Minute); err != nil || timeout != v.expected {
+			t.Errorf("%q parsed as %v: %v", v.value, timeout, err)
+		}
+	}
+
+	for _, value := range []string{"15", "-1m", "soon"} {
+		if _, err := ParseAgentTimeout(value, time.Minute); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
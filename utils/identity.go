@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"loki/config"
+	"loki/crypto"
+	"loki/log"
+	pb "loki/storage"
+	"os"
+)
+
+// unlockedIdentity caches the identity once the user provided its password.
+var unlockedIdentity *crypto.Identity
+
+// WriteNewIdentity creates a fresh identity and stores it at path. The private key is encrypted with a key
+// derived from the given password using a random salt and the default Argon2id costs.
+func WriteNewIdentity(path string, password []byte) (*crypto.Identity, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, errors.New("identity already exists: " + path)
+	}
+
+	id, err := crypto.NewIdentity()
+
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := crypto.NewKDFParameters()
+
+	if err != nil {
+		return nil, err
+	}
+
+	kdf, err := crypto.NewKeyDerivator(params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the public key is authenticated together with the private key
+	privateKey, err := crypto.NewEngine().Encrypt(id.PrivateKey, kdf(password), id.PublicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	identityfile := &pb.IdentityFile{
+		Magic:      config.InnerMagic,
+		PublicKey:  id.PublicKey,
+		PrivateKey: privateKey,
+		Kdf:        params.Name,
+		Salt:       params.Salt,
+		Time:       params.Time,
+		Memory:     params.Memory,
+		Threads:    uint32(params.Threads),
+	}
+
+	serialized, err := proto.Marshal(identityfile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	if _, err := f.Write(serialized); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// LoadIdentityFile reads the identity file located at path. No password is needed for this, the public key
+// is stored in the clear.
+func LoadIdentityFile(path string) (*pb.IdentityFile, error) {
+	buffer, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, errors.New("identity not found: " + path)
+	}
+
+	identityfile := &pb.IdentityFile{}
+
+	if err := proto.Unmarshal(buffer, identityfile); err != nil || identityfile.Magic != config.InnerMagic {
+		return nil, errors.New("could not unmarshal identity: " + path)
+	}
+
+	return identityfile, nil
+}
+
+// UnlockIdentity decrypts the private key of the identity file located at path with the given password.
+func UnlockIdentity(path string, password []byte) (*crypto.Identity, error) {
+	identityfile, err := LoadIdentityFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	kdf, err := crypto.NewKeyDerivator(crypto.KDFParameters{
+		Name:    identityfile.Kdf,
+		Salt:    identityfile.Salt,
+		Time:    identityfile.Time,
+		Memory:  identityfile.Memory,
+		Threads: uint8(identityfile.Threads),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := crypto.NewEngine().Decrypt(identityfile.PrivateKey, kdf(password), identityfile.PublicKey)
+
+	if err != nil {
+		return nil, errors.New("unable to unlock identity, password?")
+	}
+
+	return &crypto.Identity{PublicKey: identityfile.PublicKey, PrivateKey: privateKey}, nil
+}
+
+// IdentityLoader returns a function providing the users identity configured in cfg. The password is only
+// prompted for the first time the identity is needed and only if the user has an identity at all.
+func IdentityLoader(cfg config.Configuration) func() (*crypto.Identity, error) {
+	return func() (*crypto.Identity, error) {
+		if unlockedIdentity != nil {
+			return unlockedIdentity, nil
+		}
+
+		path := cfg.GetIdentityFilename()
+
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+
+		log.Info("Please provide the password of your identity %s.", path)
+		password, err := PromptPassword(false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := UnlockIdentity(path, password)
+
+		if err != nil {
+			return nil, err
+		}
+
+		unlockedIdentity = id
+		return id, nil
+	}
+}
+
+// tryIdentity unlocks the users identity with the password given for the store. It returns true if this
+// succeeded, i.e. the user unlocks the store with the own password instead of the masterpassword.
+func tryIdentity(cfg config.Configuration, password []byte) bool {
+	path := cfg.GetIdentityFilename()
+
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+
+	id, err := UnlockIdentity(path, password)
+
+	if err != nil {
+		return false
+	}
+
+	log.Debug("Unlocked identity %s", path)
+	unlockedIdentity = id
+	return true
+}
@@ -1,43 +1,187 @@
 package utils
 
 import (
-	"loki/config"
-	"loki/crypto"
-	pb "loki/storage"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/golang/protobuf/proto"
+	"io"
+	"loki/config"
+	"loki/crypto"
+	"loki/log"
+	pb "loki/storage"
 	"os"
 )
 
-// WriteNewMasterfile stores a brand new created masterfile at given path
-func WriteNewMasterfile(path string) error {
+// WriteNewMasterfile stores a brand new created masterfile for the store given by cfg. Every new store gets
+// its own random salt for the key derivation. If cfg names a keyfile the store could only be unlocked
+// with it in addition to the password. The HiddenNames mode of cfg is recorded as well. The store gets a fresh
+// random ID, the agent keeps the keys of several stores apart by it.
+func WriteNewMasterfile(cfg config.Configuration) error {
+	params, err := crypto.NewKDFParameters()
+
+	if err != nil {
+		return err
+	}
+
+	params.Keyfile = len(cfg.Keyfile) > 0
+
 	// there is no number zero, we always start with 1
-	masterfile := createMasterfile(1)
+	masterfile := createMasterfile(1, params, nil)
+	masterfile.HiddenNames = cfg.HiddenNames
+
+	if masterfile.StoreId, err = newStoreID(); err != nil {
+		return err
+	}
 
 	masterfile.Print(0)
 
-	serialized, err := proto.Marshal(masterfile)
+	return storeMasterfile(cfg.GetMasterfilename(), masterfile)
+}
+
+// RaiseGenerationWithKDFInMasterfile loads masterfile given with path, increases the generation number by one,
+// replaces the KDF parameters with the given ones the key was derived with and stores the file again together
+// with a new key check.
+func RaiseGenerationWithKDFInMasterfile(path string, params crypto.KDFParameters, key crypto.Key) error {
+	masterfile, err := LoadMasterfile(path)
+
+	if err != nil {
+		return errors.New("could not load masterfile")
+	}
+
+	verifier, err := crypto.NewKeyCheck(key, masterfile.Generation+1)
 
 	if err != nil {
 		return err
 	}
 
-	return WriteFile(path, serialized)
+	raised := createMasterfile(masterfile.Generation+1, params, verifier)
+	raised.HiddenNames = masterfile.HiddenNames
 
+	if raised.StoreId, err = storeID(masterfile); err != nil {
+		return err
+	}
+
+	return storeMasterfile(path, raised)
 }
 
-// RaiseGenerationInMasterfile loads masterfile given with path, increases the generation number by one and
-// stores the file again.
-func RaiseGenerationInMasterfile(path string) error {
+// KeyProbe tries the key on an existing record of the store. It returns false if there is no record to try.
+type KeyProbe func(key crypto.Key) (bool, error)
+
+var keyProbe KeyProbe
+
+// SetKeyProbe installs the function VerifyMasterkey tries keys with on stores without a key check.
+func SetKeyProbe(probe KeyProbe) {
+	keyProbe = probe
+}
+
+// VerifyMasterkey checks the key against the key check kept in the masterfile located at path. Stores without a
+// key check verify the key against an existing record instead, an empty one accepts any key. Nothing is written,
+// the key check is only created by StoreKeyCheck.
+func VerifyMasterkey(path string, key crypto.Key) error {
 	masterfile, err := LoadMasterfile(path)
 
 	if err != nil {
-		return errors.New("could not load masterfile")
+		return err
+	}
+
+	if len(masterfile.Verifier) > 0 {
+		if !crypto.VerifyKeyCheck(masterfile.Verifier, key, masterfile.Generation) {
+			return errors.New("wrong password")
+		}
+		return nil
+	}
+
+	if keyProbe != nil {
+		if found, err := keyProbe(key); found && err != nil {
+			return errors.New("wrong password")
+		}
+	}
+
+	return nil
+}
+
+// HasKeyCheck tells whether the masterfile located at path holds a key check.
+func HasKeyCheck(path string) bool {
+	masterfile, err := LoadMasterfile(path)
+	return err == nil && len(masterfile.Verifier) > 0
+}
+
+// StoreKeyCheck creates the key check in the masterfile located at path unless there is one already. The key
+// has to be verified against the records of the store or confirmed by prompting twice, since the store accepts
+// no other key afterwards. Without a key, as for team members unlocking with their identity, nothing is done.
+func StoreKeyCheck(path string, key crypto.Key) error {
+	if key == nil {
+		return nil
+	}
+
+	masterfile, err := LoadMasterfile(path)
+
+	if err != nil {
+		return err
+	}
+
+	if len(masterfile.Verifier) > 0 {
+		return nil
 	}
 
-	masterfile = createMasterfile(masterfile.Generation + 1)
+	if masterfile.Verifier, err = crypto.NewKeyCheck(key, masterfile.Generation); err != nil {
+		return err
+	}
+
+	if err := storeMasterfile(path, masterfile); err != nil {
+		return fmt.Errorf("could not store key check in masterfile: %v", err)
+	}
+
+	log.Debug("Stored key check in masterfile.")
+	return nil
+}
+
+// AddStoreID gives stores created before there were store IDs a random one and stores it in the masterfile
+// located at path. It is only called by commands modifying the store, until then the store has the empty ID.
+func AddStoreID(path string) error {
+	masterfile, err := LoadMasterfile(path)
+
+	if err != nil {
+		return err
+	}
+
+	if len(masterfile.StoreId) > 0 {
+		return nil
+	}
+
+	if masterfile.StoreId, err = newStoreID(); err != nil {
+		return err
+	}
+
+	return storeMasterfile(path, masterfile)
+}
+
+// storeID returns the ID of the store, stores created before there were store IDs get a random one.
+func storeID(masterfile *pb.MasterFile) (string, error) {
+	if len(masterfile.StoreId) > 0 {
+		return masterfile.StoreId, nil
+	}
+
+	return newStoreID()
+}
+
+// newStoreID returns a random version 4 UUID.
+func newStoreID() (string, error) {
+	id := make([]byte, 16)
+
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
 
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+func storeMasterfile(path string, masterfile *pb.MasterFile) error {
 	serialized, err := proto.Marshal(masterfile)
 
 	if err != nil {
@@ -47,7 +191,7 @@ func RaiseGenerationInMasterfile(path string) error {
 	return WriteFile(path, serialized)
 }
 
-func createMasterfile(generation uint32) *pb.MasterFile {
+func createMasterfile(generation uint32, params crypto.KDFParameters, verifier []byte) *pb.MasterFile {
 
 	b := make([]byte, 4)
 	binary.BigEndian.PutUint32(b, generation)
@@ -57,9 +201,70 @@ func createMasterfile(generation uint32) *pb.MasterFile {
 	masterfile.Md5 = Hexdump(crypto.ComputeMD5checksum(b))
 	masterfile.Generation = generation
 
+	masterfile.Kdf = params.Name
+	masterfile.Salt = params.Salt
+	masterfile.Time = params.Time
+	masterfile.Memory = params.Memory
+	masterfile.Threads = uint32(params.Threads)
+	masterfile.Verifier = verifier
+	masterfile.KeyfileRequired = params.Keyfile
+
 	return &masterfile
 }
 
+// KDFParametersFromMasterfile returns the key derivation parameters recorded in the masterfile. Masterfiles
+// written before salts were introduced yield legacy parameters.
+func KDFParametersFromMasterfile(masterfile *pb.MasterFile) crypto.KDFParameters {
+	return crypto.KDFParameters{
+		Name:    masterfile.Kdf,
+		Salt:    masterfile.Salt,
+		Time:    masterfile.Time,
+		Memory:  masterfile.Memory,
+		Threads: uint8(masterfile.Threads),
+		Keyfile: masterfile.KeyfileRequired,
+	}
+}
+
+// LoadKeyDerivator builds the KeyDerivator of the store from its masterfile.
+func LoadKeyDerivator(cfg config.Configuration) (crypto.KeyDerivator, error) {
+	masterfile, err := LoadMasterfile(cfg.GetMasterfilename())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return StoreKeyDerivator(cfg, KDFParametersFromMasterfile(masterfile))
+}
+
+// StoreKeyDerivator builds the KeyDerivator for the given parameters. If they require a keyfile, the keyfile
+// configured in cfg is hashed and combined with the password.
+func StoreKeyDerivator(cfg config.Configuration, params crypto.KDFParameters) (crypto.KeyDerivator, error) {
+	kdf, err := crypto.NewKeyDerivator(params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !params.Keyfile {
+		if len(cfg.Keyfile) > 0 {
+			return nil, errors.New("the store does not use a keyfile: " + cfg.Keyfile)
+		}
+		return kdf, nil
+	}
+
+	if len(cfg.Keyfile) == 0 {
+		return nil, errors.New("the store requires a keyfile in addition to the password, give it with -k or set Keyfile in the .config file")
+	}
+
+	keyfileHash, err := crypto.HashKeyfile(cfg.Keyfile)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read keyfile: %v", err)
+	}
+
+	return crypto.WithKeyfile(kdf, keyfileHash), nil
+}
+
 // LoadMasterfile returns a valid systems masterfile located at path.
 func LoadMasterfile(path string) (*pb.MasterFile, error) {
 
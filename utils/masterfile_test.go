@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+
+	"loki/config"
+	"loki/crypto"
+)
+
+func TestVerifyMasterkey(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "loki_masterfile_test")
+	defer os.RemoveAll(dir)
+	cfg := config.Configuration{SystemDir: dir}
+	path := cfg.GetMasterfilename()
+
+	key, _ := crypto.NewRandomKey()
+	other, _ := crypto.NewRandomKey()
+	localKey, localOther := crypto.LocalKey(key), crypto.LocalKey(other)
+
+	if err := WriteNewMasterfile(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty store accepts any key without pinning it
+	if err := VerifyMasterkey(path, localKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if HasKeyCheck(path) {
+		t.Fatal("key check stored while verifying")
+	}
+
+	if err := StoreKeyCheck(path, localKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing key check is never replaced
+	if err := StoreKeyCheck(path, localOther); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyMasterkey(path, localOther); err == nil {
+		t.Error("wrong key accepted")
+	}
+
+	masterfile, _ := LoadMasterfile(path)
+
+	if err := RaiseGenerationWithKDFInMasterfile(path, KDFParametersFromMasterfile(masterfile), localOther); err != nil {
+		t.Fatal(err)
+	}
+
+	if VerifyMasterkey(path, localKey) == nil || VerifyMasterkey(path, localOther) != nil {
+		t.Error("key check not renewed")
+	}
+}
+
+func TestVerifyMasterkeyWithProbe(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "loki_masterfile_test")
+	defer os.RemoveAll(dir)
+	defer SetKeyProbe(nil)
+	cfg := config.Configuration{SystemDir: dir}
+	path := cfg.GetMasterfilename()
+
+	key, _ := crypto.NewRandomKey()
+	WriteNewMasterfile(cfg)
+
+	SetKeyProbe(func(key crypto.Key) (bool, error) { return true, errors.New("unable to decrypt") })
+
+	if err := VerifyMasterkey(path, crypto.LocalKey(key)); err == nil {
+		t.Error("key failing the probe accepted")
+	}
+
+	if masterfile, _ := LoadMasterfile(path); len(masterfile.Verifier) > 0 {
+		t.Error("key check created for wrong key")
+	}
+}
+
+func TestStoreID(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "loki_masterfile_test")
+	defer os.RemoveAll(dir)
+	cfg := config.Configuration{SystemDir: dir}
+	path := cfg.GetMasterfilename()
+
+	WriteNewMasterfile(cfg)
+	masterfile, _ := LoadMasterfile(path)
+	params := KDFParametersFromMasterfile(masterfile)
+	key, _ := crypto.NewRandomKey()
+
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(masterfile.StoreId) {
+		t.Errorf("invalid store ID: %s", masterfile.StoreId)
+	}
+
+	if err := RaiseGenerationWithKDFInMasterfile(path, params, crypto.LocalKey(key)); err != nil {
+		t.Fatal(err)
+	}
+
+	if raised, _ := LoadMasterfile(path); raised.StoreId != masterfile.StoreId || raised.Generation != 2 {
+		t.Errorf("store ID %s, generation %d after raising", raised.StoreId, raised.Generation)
+	}
+
+	// stores older than store IDs get one when modified
+	masterfile.StoreId = ""
+	storeMasterfile(path, masterfile)
+
+	if err := RaiseGenerationWithKDFInMasterfile(path, params, crypto.LocalKey(key)); err != nil {
+		t.Fatal(err)
+	}
+
+	if raised, _ := LoadMasterfile(path); len(raised.StoreId) == 0 || raised.StoreId == masterfile.StoreId {
+		t.Errorf("no store ID after raising: %q", raised.StoreId)
+	}
+
+	masterfile.StoreId = ""
+	storeMasterfile(path, masterfile)
+
+	if err := AddStoreID(path); err != nil {
+		t.Fatal(err)
+	}
+
+	added, _ := LoadMasterfile(path)
+
+	if len(added.StoreId) == 0 {
+		t.Error("no store ID added")
+	}
+
+	if err := AddStoreID(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if kept, _ := LoadMasterfile(path); kept.StoreId != added.StoreId {
+		t.Errorf("store ID replaced: %s -> %s", added.StoreId, kept.StoreId)
+	}
+}
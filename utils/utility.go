@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"loki/config"
+	"loki/crypto"
 	"loki/log"
 	pb "loki/storage"
 	"os"
@@ -17,16 +18,26 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
+var readPassword = func() ([]byte, error) {
+	return terminal.ReadPassword(int(syscall.Stdin))
+}
+
+// SetPasswordReader replaces reading passwords from the terminal, tests answer the prompts this way.
+func SetPasswordReader(reader func() ([]byte, error)) {
+	readPassword = reader
+}
+
 // PromptPassword prompts the user for a password, optional twice and verifies equality if needed.
 func PromptPassword(twice bool) ([]byte, error) {
 	log.Info("Enter Password: ")
-	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+	bytePassword, err := readPassword()
 
 	if twice {
 		log.Info("\nRe-enter Password again: ")
-		bytePasswordAgain, err := terminal.ReadPassword(int(syscall.Stdin))
+		bytePasswordAgain, err := readPassword()
 
 		if err != nil {
 			return []byte{}, errors.New("problems reading second password from terminal")
@@ -123,13 +134,20 @@ func InitBasedir(cfg config.Configuration) error {
 		return err
 	}
 
-	err = WriteNewMasterfile(cfg.GetMasterfilename())
+	err = WriteNewMasterfile(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	// the password is confirmed once and pinned right away, the store never accepts another one
+	err = pinNewMasterkey(cfg)
 
 	if err != nil {
 		return err
 	}
 
-	err = createConfigfile(dirname, cfg.Gitmode)
+	err = createConfigfile(dirname, cfg.Gitmode, cfg.Keyfile)
 
 	if err != nil {
 		return err
@@ -170,25 +188,48 @@ func InitBasedir(cfg config.Configuration) error {
 	return nil
 }
 
+func pinNewMasterkey(cfg config.Configuration) error {
+	kdf, err := LoadKeyDerivator(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("Choose the masterpassword of the new store.")
+	key, err := PromptMasterkey(kdf, true)
+
+	if err != nil {
+		return err
+	}
+
+	return StoreKeyCheck(cfg.GetMasterfilename(), key)
+}
+
 func gitAddFile(filename string) error {
 	gitCmd := []string{"add", filename}
 	log.Debug("Running git command: %v", gitCmd)
 	return GitCommand(gitCmd)
 }
 
-func createConfigfile(dirname string, withGit bool) error {
+func createConfigfile(dirname string, withGit bool, keyfile string) error {
 
 	dst := dirname + string(os.PathSeparator) + config.ConfigFilename
 
 	log.Debug("Create configfile: %s", dst)
 
-	data := []byte(createConfigfileTemplate(withGit))
+	data := []byte(createConfigfileTemplate(withGit, keyfile))
 
 	return WriteFile(dst, data)
 }
 
-func createConfigfileTemplate(withGit bool) string {
-	return fmt.Sprintf("[basic]\nLoglevel = INFO\nExternalEditor = false\nGitmode = %t\n", withGit)
+func createConfigfileTemplate(withGit bool, keyfile string) string {
+	template := fmt.Sprintf("[basic]\nLoglevel = INFO\nExternalEditor = false\nGitmode = %t\nPadding = %s\n", withGit, config.DefaultPadding)
+
+	if len(keyfile) > 0 {
+		template += fmt.Sprintf("Keyfile = %s\n", keyfile)
+	}
+
+	return template
 }
 
 // CopyFile copies a file content to a new location.
@@ -280,7 +321,7 @@ func PrefixedDisplay(rec *pb.Record, spacing int, blind bool) {
 }
 
 // PrefixedDisplayWithHighlighting displays the given record at the coulunn given with spacing and
-// highlights the searchstring if found. Hides password if blind == true
+// highlights the searchstring if found. Hides password and concealed fields if blind == true
 func PrefixedDisplayWithHighlighting(rec *pb.Record, spacing int, searchstring string, blind bool) {
 
 	p := func(text string, searchstring string) string {
@@ -293,13 +334,40 @@ func PrefixedDisplayWithHighlighting(rec *pb.Record, spacing int, searchstring s
 	log.Debug("%*s%s%s", spacing, "", config.MagicLabel, p(rec.Magic, searchstring))
 	log.Debug("%*s%s%s", spacing, "", config.MD5Label, p(rec.Md5, searchstring))
 	log.Info("%*s%s%s", spacing, "", config.TitleLabel, p(rec.Title, searchstring))
-	log.Info("%*s%s%s", spacing, "", config.AccountLabel, p(rec.Account, searchstring))
 
-	if blind {
-		bLen := len(rec.Password)
-		log.Info("%*s%s%s", spacing, "", config.PasswordLabel, strings.Repeat("*", bLen))
+	if rec.Type == pb.RecordType_LOGIN {
+		log.Info("%*s%s%s", spacing, "", config.AccountLabel, p(rec.Account, searchstring))
+
+		if blind {
+			log.Info("%*s%s%s", spacing, "", config.PasswordLabel, config.SecretMask)
+		} else {
+			log.Info("%*s%s%s", spacing, "", config.PasswordLabel, p(rec.Password, searchstring))
+		}
 	} else {
-		log.Info("%*s%s%s", spacing, "", config.PasswordLabel, p(rec.Password, searchstring))
+		log.Info("%*s%s%s", spacing, "", config.TypeLabel, rec.Type.Name())
+	}
+
+	if key := rec.GetSshKey().GetPrivateKey(); len(key) > 0 {
+		if blind {
+			log.Info("%*s%s(hidden)", spacing, "", config.PrivateKeyLabel)
+		} else {
+			log.Info("%*s%s", spacing, "", config.PrivateKeyLabel)
+			log.Info("%*s%s", spacing, "", strings.TrimSuffix(key, "\n"))
+		}
+	}
+
+	for _, field := range rec.TypedFields() {
+		value := *field.Value
+
+		if len(value) == 0 {
+			continue
+		}
+
+		if blind && field.Secret {
+			log.Info("%*s%s%s", spacing, "", field.Label, maskSecret(field.Label, value))
+		} else {
+			log.Info("%*s%s%s", spacing, "", field.Label, p(value, searchstring))
+		}
 	}
 
 	if len(rec.Tags) > 0 {
@@ -312,6 +380,31 @@ func PrefixedDisplayWithHighlighting(rec *pb.Record, spacing int, searchstring s
 		log.Info("%*s%s%s", spacing, "", config.URLLabel, p(rec.Url, searchstring))
 	}
 
+	if len(rec.Otpauth) > 0 {
+		// the secret is never shown, loki otp displays the codes
+		if otp, err := crypto.ParseOTP(rec.Otpauth); err == nil {
+			log.Info("%*s%s%s (%s)", spacing, "", config.OTPLabel, p(otp.Label, searchstring), otp.Type)
+		} else {
+			log.Info("%*s%s%v", spacing, "", config.OTPLabel, err)
+		}
+	}
+
+	if rec.Expires > 0 {
+		log.Info("%*s%s%s", spacing, "", config.ExpiresLabel, pb.FormatDate(rec.Expires))
+	}
+
+	for _, field := range rec.Fields {
+		if blind && field.Concealed {
+			log.Info("%*s%s%s", spacing, "", p(field.Label(), searchstring), config.SecretMask)
+		} else {
+			log.Info("%*s%s%s", spacing, "", p(field.Label(), searchstring), p(field.Value, searchstring))
+		}
+	}
+
+	for _, attachment := range rec.Attachments {
+		log.Info("%*s%s%s (%s, %d bytes)", spacing, "", config.AttachmentLabel, p(attachment.Name, searchstring), attachment.MimeType, len(attachment.Data))
+	}
+
 	if len(rec.Notes) > 0 {
 		log.Info("")
 
@@ -322,6 +415,26 @@ func PrefixedDisplayWithHighlighting(rec *pb.Record, spacing int, searchstring s
 		log.Info("%*s%s", spacing, "", p(rec.Notes, searchstring))
 		log.Info(separator)
 	}
+
+	if rec.Modified > 0 {
+		log.Info("")
+		log.Info("%*s%s%s", spacing, "", config.CreatedLabel, time.Unix(rec.Created, 0).Format(config.TimeFormat))
+		log.Info("%*s%s%s", spacing, "", config.ModifiedLabel, time.Unix(rec.Modified, 0).Format(config.TimeFormat))
+
+		if rec.Type == pb.RecordType_LOGIN {
+			log.Info("%*s%s%s", spacing, "", config.ChangedLabel, time.Unix(rec.PasswordChanged, 0).Format(config.TimeFormat))
+		}
+	}
+}
+
+// maskSecret masks the value of a secret typed field. Card numbers keep their last four digits, so the card
+// could still be told apart.
+func maskSecret(label string, value string) string {
+	if label == config.NumberLabel && len(value) > 4 {
+		return config.SecretMask + value[len(value)-4:]
+	}
+
+	return config.SecretMask
 }
 
 // CreateLeadingDirectories create the leading directories if they are missing
@@ -467,6 +580,12 @@ func GitCommand(params []string) error {
 	return cmd.Run()
 }
 
+// GitHasStagedChanges tells whether the staged files of the repository in the current directory differ from the last
+// commit. If git could not tell, they are taken as changed.
+func GitHasStagedChanges() bool {
+	return exec.Command("git", "diff", "--cached", "--quiet").Run() != nil
+}
+
 // LongestLine is supposed to get an multi-line string (\n terminated) and returns
 // the width of the longest line in int.
 func LongestLine(input string) int {